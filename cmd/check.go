@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Run the mutation against the pod in podFile and print the resulting patch to out
+func runCheck(podFile string, out io.Writer) error {
+	data, err := ioutil.ReadFile(podFile)
+	if err != nil {
+		return fmt.Errorf("could not read pod file %s: %v", podFile, err)
+	}
+
+	var pod corev1.Pod
+	if err := yaml.Unmarshal(data, &pod); err != nil {
+		return fmt.Errorf("could not parse pod file %s: %v", podFile, err)
+	}
+
+	patchBytes, err := createPatch(context.Background(), requestLogger{}, &pod, nil)
+	if err != nil {
+		return err
+	}
+	if len(patchBytes) == 0 {
+		_, err = fmt.Fprintln(out, "no changes")
+		return err
+	}
+	_, err = fmt.Fprintln(out, string(patchBytes))
+	return err
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Write the pod YAML to a new file in the test's temp dir
+func writePodFile(t *testing.T, podName string) string {
+	t.Helper()
+	content := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: ` + podName + `
+  namespace: default
+  annotations:
+    ` + annotation + `.podDefinition: '` + brokerDefinition + `'
+spec:
+  containers:
+  - name: broker
+    image: broker:1
+`
+	path := filepath.Join(t.TempDir(), "pod.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunCheck(t *testing.T) {
+	var out bytes.Buffer
+	if err := runCheck(writePodFile(t, "broker-0"), &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `[{"op":"replace","path":"/spec/containers/0/image","value":"broker:2"}]`
+	if got := strings.TrimSpace(out.String()); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+
+	out.Reset()
+	if err := runCheck(writePodFile(t, "other-0"), &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := strings.TrimSpace(out.String()); got != "no changes" {
+		t.Fatalf("expected no changes, got %s", got)
+	}
+}
+
+func TestRunCheckMissingFile(t *testing.T) {
+	if err := runCheck(filepath.Join(t.TempDir(), "missing.yaml"), &bytes.Buffer{}); err == nil {
+		t.Fatal("expected an error for a missing pod file")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/morvencao/kube-mutating-webhook-tutorial/pkg/mutation"
+)
+
+const (
+	configReadAttempts = 3
+	configReadBackoff  = 100 * time.Millisecond
+
+	// how long a failure to parse a pod definition is remembered
+	parseFailureWindow = time.Minute
+)
+
+var (
+	// configs loaded from the -configFile and the -configURL, nil until loaded. A loaded config is
+	// never modified, reloads swap in a new one so requests always see a whole snapshot.
+	fileConfig atomic.Pointer[mutation.Config]
+	urlConfig  atomic.Pointer[mutation.Config]
+
+	// recent pod definition parse failures by annotation hash
+	parseFailuresMutex sync.Mutex
+	parseFailures      = map[[sha256.Size]byte]parseFailure{}
+)
+
+type parseFailure struct {
+	err  error
+	seen time.Time
+}
+
+// Read the config file, retrying transient read errors. A ConfigMap update swaps
+// the mounted file atomically, so a read can briefly fail while the symlink moves.
+func readConfigFile(path string) (*mutation.Config, error) {
+	c := &mutation.Config{}
+	var data []byte
+	var err error
+	backoff := configReadBackoff
+	for attempt := 1; attempt <= configReadAttempts; attempt++ {
+		data, err = ioutil.ReadFile(path)
+		if err == nil {
+			break
+		}
+		glog.Warningf("Failed to read config file %s (attempt %d/%d): %v", path, attempt, configReadAttempts, err)
+		if attempt < configReadAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	if err != nil {
+		return c, fmt.Errorf("could not read config file %s: %v", path, err)
+	}
+
+	if c, err = mutation.ParseConfig(data); err != nil {
+		return c, fmt.Errorf("could not parse config file %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// name parts of env vars whose values are redacted when the config is printed
+var sensitiveEnvNames = []string{"PASSWORD", "PASSWD", "SECRET", "TOKEN", "KEY", "CREDENTIAL"}
+
+// Return a copy of the config with the values of env vars that look like secrets replaced,
+// in every container list of the config
+func redactConfig(c *mutation.Config) *mutation.Config {
+	redacted := &mutation.Config{Profiles: c.Profiles, Pods: make([]mutation.ConfigPod, len(c.Pods))}
+	redactEnv := func(env []corev1.EnvVar) {
+		for j := range env {
+			name := strings.ToUpper(env[j].Name)
+			for _, part := range sensitiveEnvNames {
+				if env[j].Value != "" && strings.Contains(name, part) {
+					env[j].Value = "REDACTED"
+					break
+				}
+			}
+		}
+	}
+	for i, cpod := range c.Pods {
+		cpod.Spec = *cpod.Spec.DeepCopy()
+		for j := range cpod.Spec.Containers {
+			redactEnv(cpod.Spec.Containers[j].Env)
+		}
+		for j := range cpod.Spec.InitContainers {
+			redactEnv(cpod.Spec.InitContainers[j].Env)
+		}
+		for j := range cpod.Spec.EphemeralContainers {
+			redactEnv(cpod.Spec.EphemeralContainers[j].Env)
+		}
+		cpod.ContainersByIndex = redactIndexed(cpod.ContainersByIndex, redactEnv)
+		cpod.InitContainersByIndex = redactIndexed(cpod.InitContainersByIndex, redactEnv)
+		inserts := make([]mutation.InitContainerInsert, len(cpod.InsertInitContainers))
+		for j, insert := range cpod.InsertInitContainers {
+			insert.Container = *insert.Container.DeepCopy()
+			redactEnv(insert.Container.Env)
+			inserts[j] = insert
+		}
+		cpod.InsertInitContainers = inserts
+		redacted.Pods[i] = cpod
+	}
+	return redacted
+}
+
+// Copy the config containers targeting pod containers by position, redacting their env
+func redactIndexed(targets []mutation.IndexedContainer, redactEnv func([]corev1.EnvVar)) []mutation.IndexedContainer {
+	copied := make([]mutation.IndexedContainer, len(targets))
+	for i, target := range targets {
+		target.Container = *target.Container.DeepCopy()
+		redactEnv(target.Container.Env)
+		copied[i] = target
+	}
+	return copied
+}
+
+// Read and validate the config file, replacing the loaded config on success. On failure
+// the config loaded last stays in use.
+func loadConfigFile(path string) (*mutation.Config, error) {
+	c, err := readConfigFile(path)
+	if err != nil {
+		return c, err
+	}
+	return c, storeConfig(&fileConfig, path, c)
+}
+
+// Check the config read from the source and store it in the slot of its source. An
+// invalid config leaves the current one in place.
+func storeConfig(slot *atomic.Pointer[mutation.Config], source string, c *mutation.Config) error {
+	if maxConfigPods > 0 && len(c.Pods) > maxConfigPods {
+		return fmt.Errorf("config %s holds %d pods, more than %d", source, len(c.Pods), maxConfigPods)
+	}
+	if err := c.Validate(); err != nil {
+		return fmt.Errorf("invalid config %s: %v", source, err)
+	}
+
+	slot.Store(c)
+	return nil
+}
+
+// Return the config used for pods without a podDefinition annotation, if any. Once
+// fetched, the -configURL config takes precedence over the -configFile one.
+func currentFileConfig() (*mutation.Config, bool) {
+	if c := urlConfig.Load(); c != nil {
+		return c, true
+	}
+	c := fileConfig.Load()
+	return c, c != nil
+}
+
+// Look up the config for a request without podDefinition annotations. It takes the request
+// context so a lookup that has to go out, e.g. to the API server, ends with the request.
+var lookupConfig = func(ctx context.Context) (*mutation.Config, bool) {
+	return currentFileConfig()
+}
+
+// Return the values of the "<annotation>.podDefinition" annotation followed by the
+// numbered "<annotation>.podDefinition.<n>" annotations in ascending order
+func podDefinitions(logger requestLogger, annotations map[string]string) []string {
+	key := annotation + ".podDefinition"
+
+	var definitions []string
+	if value, ok := annotations[key]; ok {
+		definitions = append(definitions, value)
+	}
+
+	var numbered []string
+	for k := range annotations {
+		if !strings.HasPrefix(k, key+".") {
+			continue
+		}
+		if _, err := strconv.Atoi(strings.TrimPrefix(k, key+".")); err != nil {
+			logger.Warningf("Ignoring annotation %s; expected a numbered podDefinition", k)
+			continue
+		}
+		numbered = append(numbered, k)
+	}
+	sort.Slice(numbered, func(i, j int) bool {
+		ni, _ := strconv.Atoi(strings.TrimPrefix(numbered[i], key+"."))
+		nj, _ := strconv.Atoi(strings.TrimPrefix(numbered[j], key+"."))
+		return ni < nj
+	})
+	for _, k := range numbered {
+		definitions = append(definitions, annotations[k])
+	}
+	return definitions
+}
+
+// Return the error of a recent failure to parse the given pod definition, or nil
+func cachedParseFailure(definition string) error {
+	key := sha256.Sum256([]byte(definition))
+
+	parseFailuresMutex.Lock()
+	defer parseFailuresMutex.Unlock()
+	failure, ok := parseFailures[key]
+	if !ok {
+		return nil
+	}
+	if time.Since(failure.seen) > parseFailureWindow {
+		delete(parseFailures, key)
+		return nil
+	}
+	return failure.err
+}
+
+// Remember a failure to parse the given pod definition
+func recordParseFailure(definition string, err error) {
+	key := sha256.Sum256([]byte(definition))
+	now := time.Now()
+
+	parseFailuresMutex.Lock()
+	defer parseFailuresMutex.Unlock()
+	for k, failure := range parseFailures {
+		if now.Sub(failure.seen) > parseFailureWindow {
+			delete(parseFailures, k)
+		}
+	}
+	parseFailures[key] = parseFailure{err: err, seen: now}
+}
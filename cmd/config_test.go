@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// config file content replacing the image of the broker container of broker-0
+const brokerConfig = `
+Pods:
+- metadata:
+    name: broker-0
+  spec:
+    containers:
+    - name: broker
+      image: broker:2
+`
+
+// Write the config file content to a new file in the test's temp dir
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadConfigFileRetries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	// the file shows up after the first attempt, as after a ConfigMap symlink swap
+	go func() {
+		time.Sleep(configReadBackoff / 2)
+		ioutil.WriteFile(path, []byte(brokerConfig), 0644)
+	}()
+
+	c, err := readConfigFile(path)
+	if err != nil {
+		t.Fatalf("expected the read to succeed on retry, got %v", err)
+	}
+	if len(c.Pods) != 1 || c.Pods[0].Name != "broker-0" {
+		t.Fatalf("expected the broker-0 config pod, got %v", c.Pods)
+	}
+}
+
+func TestReadConfigFileUnknownField(t *testing.T) {
+	path := writeConfigFile(t, strings.Replace(brokerConfig, "image:", "imag:", 1))
+	if _, err := readConfigFile(path); err == nil {
+		t.Fatal("expected an error for the misspelled image field")
+	}
+}
+
+func TestReadConfigFileGivesUp(t *testing.T) {
+	if _, err := readConfigFile(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Fatal("expected an error for a file that never shows up")
+	}
+}
+
+func TestPodDefinitionsOrder(t *testing.T) {
+	key := annotation + ".podDefinition"
+	definitions := podDefinitions(requestLogger{}, map[string]string{
+		key:          "a",
+		key + ".10":  "d",
+		key + ".2":   "c",
+		key + ".1":   "b",
+		key + ".foo": "ignored",
+	})
+	if want := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(definitions, want) {
+		t.Fatalf("expected %v, got %v", want, definitions)
+	}
+}
+
+func TestLoadConfigFileMaxConfigPods(t *testing.T) {
+	defer func(max int) { maxConfigPods = max }(maxConfigPods)
+	defer fileConfig.Store(nil)
+	maxConfigPods = 1
+
+	path := writeConfigFile(t, brokerConfig+"- metadata:\n    name: broker-1\n")
+	if _, err := loadConfigFile(path); err == nil {
+		t.Fatal("expected an error for a config file with too many pods")
+	}
+	if _, loaded := currentFileConfig(); loaded {
+		t.Fatal("expected the config not to be loaded")
+	}
+}
+
+func TestReloadWhileServing(t *testing.T) {
+	defer fileConfig.Store(nil)
+	// both containers of a config get the same image version, a torn read would mix them
+	paths := make([]string, 2)
+	for i := range paths {
+		paths[i] = writeConfigFile(t, fmt.Sprintf(`
+Pods:
+- metadata:
+    name: broker-0
+  spec:
+    containers:
+    - name: broker
+      image: broker:%[1]d
+    - name: monitor
+      image: monitor:%[1]d
+`, i+2))
+	}
+	if _, err := loadConfigFile(paths[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	reloaded := make(chan struct{})
+	go func() {
+		defer close(reloaded)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := loadConfigFile(paths[i%2]); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	pod := testPod("broker-0", "", "broker", "monitor")
+	for i := 0; i < 200; i++ {
+		patch := string(review(t, pod).Patch)
+		if !strings.Contains(patch, `"broker:2"`) == strings.Contains(patch, `"monitor:2"`) {
+			t.Fatalf("expected both containers patched from the same config, got %s", patch)
+		}
+	}
+	close(done)
+	<-reloaded
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	eventComponent = "pod-modifier-webhook"
+
+	// how often node allocatable resources are listed for -checkNodeAllocatable
+	nodeRefreshInterval = time.Minute
+)
+
+// allocatable resources of the cluster's nodes, nil unless -checkNodeAllocatable is set
+var nodeAllocatable atomic.Pointer[[]corev1.ResourceList]
+
+// Create a client for the API server the webhook runs in
+func newKubeClient() (kubernetes.Interface, error) {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(restConfig)
+}
+
+// Create a recorder emitting events through the client
+func newEventRecorder(client kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(glog.Infof)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent})
+}
+
+// Check that the API server answers its /healthz endpoint
+func pingAPIServer(ctx context.Context, client kubernetes.Interface) error {
+	return client.Discovery().RESTClient().Get().AbsPath("/healthz").Do(ctx).Error()
+}
+
+// List the nodes' allocatable resources every nodeRefreshInterval, forever
+func refreshNodeAllocatable(client kubernetes.Interface) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), nodeRefreshInterval)
+		if err := listNodeAllocatable(ctx, client); err != nil {
+			glog.Errorf("Failed to list nodes: %v", err)
+		}
+		cancel()
+		time.Sleep(nodeRefreshInterval)
+	}
+}
+
+// List the nodes' allocatable resources once and store them for the pod checks
+func listNodeAllocatable(ctx context.Context, client kubernetes.Interface) error {
+	nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	// nil without nodes, so no pod is warned about fitting none of them
+	var allocatable []corev1.ResourceList
+	for _, node := range nodes.Items {
+		allocatable = append(allocatable, node.Status.Allocatable)
+	}
+	nodeAllocatable.Store(&allocatable)
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func TestReadyzAPIServer(t *testing.T) {
+	var healthy atomic.Bool
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || !healthy.Load() {
+			http.Error(w, "unhealthy", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: apiServer.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	whsvr := &WebhookServer{client: client, readyCheckAPI: true, requestTimeout: time.Second}
+	readyz := func() int {
+		rec := httptest.NewRecorder()
+		whsvr.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code
+	}
+
+	for _, up := range []bool{true, false, true} {
+		healthy.Store(up)
+		want := http.StatusOK
+		if !up {
+			want = http.StatusServiceUnavailable
+		}
+		if code := readyz(); code != want {
+			t.Fatalf("expected status %d with a healthy API server %t, got %d", want, up, code)
+		}
+	}
+
+	// -requestTimeout=0 sets no deadline, the check doesn't expire at once
+	whsvr.requestTimeout = 0
+	if code := readyz(); code != http.StatusOK {
+		t.Fatalf("expected status %d without a request timeout, got %d", http.StatusOK, code)
+	}
+
+	whsvr.client = nil
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d without a client, got %d", http.StatusServiceUnavailable, code)
+	}
+}
+
+// Node with the allocatable memory
+func testNode(name string, memory string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{
+			Allocatable: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse(memory)},
+		},
+	}
+}
+
+func TestNodeAllocatableWarning(t *testing.T) {
+	defer nodeAllocatable.Store(nil)
+	client := fake.NewSimpleClientset(testNode("node-1", "8Gi"), testNode("node-2", "12Gi"))
+	if err := listNodeAllocatable(context.Background(), client); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	definition := `{"Pods":[{"metadata":{"name":"broker-0"},"spec":{"containers":[{"name":"broker","resources":{"requests":{"memory":"16Gi"}}}]}}]}`
+	response := review(t, testPod("broker-0", definition, "broker"))
+	if !response.Allowed || len(response.Patch) == 0 {
+		t.Fatal("expected the pod to be patched despite the warning")
+	}
+	if len(response.Warnings) != 1 || !strings.Contains(response.Warnings[0], "more resources than any node can allocate") {
+		t.Fatalf("expected a node allocatable warning, got %v", response.Warnings)
+	}
+}
+
+func TestNodeAllocatableWithoutNodes(t *testing.T) {
+	defer nodeAllocatable.Store(nil)
+	if err := listNodeAllocatable(context.Background(), fake.NewSimpleClientset()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	definition := `{"Pods":[{"metadata":{"name":"broker-0"},"spec":{"containers":[{"name":"broker","resources":{"requests":{"memory":"16Gi"}}}]}}]}`
+	response := review(t, testPod("broker-0", definition, "broker"))
+	if !response.Allowed || len(response.Patch) == 0 {
+		t.Fatal("expected the pod to be patched")
+	}
+	if len(response.Warnings) != 0 {
+		t.Fatalf("expected no node allocatable warning without nodes, got %v", response.Warnings)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// only warnings are returned to the client
+	warnLevelWarning = "warning"
+	// informational messages are returned to the client as well
+	warnLevelInfo = "info"
+
+	// distinct lines counted for -logSampleRate before the counts start over
+	maxLogSamples = 10000
+)
+
+// Outcome of a request an info line reports, part of the -logSampleRate sample key.
+// A patched pod needs no tag, its patch line is never sampled.
+type logOutcome string
+
+const (
+	outcomeNoChanges logOutcome = "no changes"
+	outcomeSkipped   logOutcome = "skipped"
+)
+
+var (
+	// info lines seen per format string and outcome, for -logSampleRate
+	logSamplesMutex sync.Mutex
+	logSamples      = map[string]uint64{}
+)
+
+// Check whether an info line is logged. With -logSampleRate N only the first of every N
+// lines with the same format string and outcome is. The arguments, pod names and UIDs
+// among them, are left out, so a rollout of broker-0..broker-N is sampled as one line.
+func sampled(outcome logOutcome, format string) bool {
+	if logSampleRate <= 1 {
+		return true
+	}
+	logSamplesMutex.Lock()
+	defer logSamplesMutex.Unlock()
+	if len(logSamples) >= maxLogSamples {
+		logSamples = map[string]uint64{}
+	}
+	key := string(outcome) + "\x00" + format
+	n := logSamples[key]
+	logSamples[key] = n + 1
+	return n%uint64(logSampleRate) == 0
+}
+
+// Logger for a single admission request, every line is prefixed with the request UID.
+// Warnings, and notices with -warnLevel=info, are collected for the admission response.
+type requestLogger struct {
+	uid      types.UID
+	warnings *[]string
+
+	// log every info line, -logSampleRate aside; for the mutation's per-pod lines
+	unsampled bool
+}
+
+func (l requestLogger) addWarning(msg string) {
+	if l.warnings != nil {
+		*l.warnings = append(*l.warnings, msg)
+	}
+}
+
+// Warnings collected for the admission response
+func (l requestLogger) responseWarnings() []string {
+	if l.warnings == nil || len(*l.warnings) == 0 {
+		return nil
+	}
+	return *l.warnings
+}
+
+func (l requestLogger) prefix() string {
+	if l.uid == "" {
+		return ""
+	}
+	return fmt.Sprintf("[%s] ", l.uid)
+}
+
+// V reports whether verbose logging at the given level is enabled
+func (l requestLogger) V(level int) bool {
+	return bool(glog.V(glog.Level(level)))
+}
+
+// Info lines are never sampled, e.g. the patch returned for a pod
+func (l requestLogger) Info(args ...interface{}) {
+	glog.InfoDepth(1, l.prefix()+fmt.Sprint(args...))
+}
+
+func (l requestLogger) Infof(format string, args ...interface{}) {
+	if l.unsampled || sampled("", format) {
+		glog.InfoDepth(1, l.prefix()+fmt.Sprintf(format, args...))
+	}
+}
+
+// Outcomef logs an info line reporting the outcome of the request, sampled per outcome
+func (l requestLogger) Outcomef(outcome logOutcome, format string, args ...interface{}) {
+	if sampled(outcome, format) {
+		glog.InfoDepth(1, l.prefix()+fmt.Sprintf(format, args...))
+	}
+}
+
+// Noticef logs an informational message that is also returned to the client with -warnLevel=info
+func (l requestLogger) Noticef(outcome logOutcome, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if sampled(outcome, format) {
+		glog.InfoDepth(1, l.prefix()+msg)
+	}
+	if warnLevel == warnLevelInfo {
+		l.addWarning(msg)
+	}
+}
+
+func (l requestLogger) Warning(args ...interface{}) {
+	msg := fmt.Sprint(args...)
+	glog.WarningDepth(1, l.prefix()+msg)
+	l.addWarning(msg)
+}
+
+func (l requestLogger) Warningf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	glog.WarningDepth(1, l.prefix()+msg)
+	l.addWarning(msg)
+}
+
+func (l requestLogger) Error(args ...interface{}) {
+	glog.ErrorDepth(1, l.prefix()+fmt.Sprint(args...))
+}
+
+func (l requestLogger) Errorf(format string, args ...interface{}) {
+	glog.ErrorDepth(1, l.prefix()+fmt.Sprintf(format, args...))
+}
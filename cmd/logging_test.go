@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Run f with glog logging to stderr and return what it logged
+func captureLogs(t *testing.T, f func()) string {
+	t.Helper()
+	logtostderr := flag.Lookup("logtostderr").Value.String()
+	defer flag.Set("logtostderr", logtostderr)
+	flag.Set("logtostderr", "true")
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		logged <- string(data)
+	}()
+
+	stderr := os.Stderr
+	os.Stderr = w
+	f()
+	os.Stderr = stderr
+	w.Close()
+	return <-logged
+}
+
+// Run f at the glog verbosity level
+func atLogLevel(level string, f func()) {
+	v := flag.Lookup("v").Value.String()
+	defer flag.Set("v", v)
+	flag.Set("v", level)
+	f()
+}
+
+func TestLogSampleRate(t *testing.T) {
+	defer func(rate int) { logSampleRate = rate }(logSampleRate)
+	logSampleRate = 3
+
+	// a rollout: every line names another pod, the lines are sampled all the same
+	logged := captureLogs(t, func() {
+		for i := 0; i < 7; i++ {
+			logger := requestLogger{uid: types.UID(fmt.Sprintf("uid-%d", i))}
+			logger.Infof("Create patch for pod: %s/%s (sample test)", fmt.Sprintf("broker-%d", i), "default")
+		}
+	})
+	for i := 0; i < 7; i++ {
+		line := fmt.Sprintf("[uid-%d] Create patch for pod: broker-%d/default (sample test)", i, i)
+		if want := i%3 == 0; strings.Contains(logged, line) != want {
+			t.Errorf("expected the line of broker-%d logged %t, got:\n%s", i, want, logged)
+		}
+	}
+}
+
+func TestLogSampleRatePerOutcome(t *testing.T) {
+	defer func(rate int) { logSampleRate = rate }(logSampleRate)
+	logSampleRate = 3
+
+	// the same format with another outcome is sampled on its own
+	logged := captureLogs(t, func() {
+		requestLogger{}.Outcomef(outcomeNoChanges, "Pod %s (outcome test)", "broker-0")
+		requestLogger{}.Outcomef(outcomeSkipped, "Pod %s (outcome test)", "broker-1")
+	})
+	for _, line := range []string{"Pod broker-0 (outcome test)", "Pod broker-1 (outcome test)"} {
+		if !strings.Contains(logged, line) {
+			t.Errorf("expected %q logged, got:\n%s", line, logged)
+		}
+	}
+}
+
+func TestLogSampleRateKeepsPatches(t *testing.T) {
+	defer func(rate int) { logSampleRate = rate }(logSampleRate)
+	logSampleRate = 3
+	pod := testPod("broker-0", brokerDefinition, "broker")
+
+	logged := captureLogs(t, func() {
+		for i := 0; i < 3; i++ {
+			review(t, pod)
+		}
+	})
+	if n := strings.Count(logged, "AdmissionResponse: patch="); n != 3 {
+		t.Fatalf("expected all 3 patches logged, got %d in:\n%s", n, logged)
+	}
+}
+
+func TestLogSampleRateKeepsDiffSummaries(t *testing.T) {
+	defer func(rate int, summary bool) { logSampleRate, logDiffSummary = rate, summary }(logSampleRate, logDiffSummary)
+	logSampleRate = 3
+	logDiffSummary = true
+
+	// every pod of the rollout gets its diff summary, the mutation's lines aren't sampled
+	logged := captureLogs(t, func() {
+		for i := 0; i < 3; i++ {
+			name := fmt.Sprintf("broker-%d", i)
+			definition := strings.Replace(brokerDefinition, "broker-0", name, 1)
+			review(t, testPod(name, definition, "broker"))
+		}
+	})
+	for i := 0; i < 3; i++ {
+		if summary := fmt.Sprintf("broker-%d: broker.image broker:1 -> broker:2", i); !strings.Contains(logged, summary) {
+			t.Errorf("expected %q logged, got:\n%s", summary, logged)
+		}
+	}
+}
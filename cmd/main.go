@@ -3,60 +3,207 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
+	"unicode"
 
 	"github.com/golang/glog"
-	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
 )
 
 const (
 	defaultAnnotation = "pod-modifier.solace.com/modify"
+	envPrefix         = "WEBHOOK_"
 )
 
+// webhook build, set with -ldflags "-X main.version=..."
+var version = "dev"
+
 var (
-	annotation string
+	enabled                  bool
+	disableFile              string
+	annotation               string
+	writeStatusAnnotation    bool
+	versionAnnotationKey     string
+	configFile               string
+	configURL                string
+	configRefresh            time.Duration
+	strictContainerMatch     bool
+	maxConfigPods            int
+	allowEphemeralContainers bool
+	warnLevel                string
+	prettyResponse           bool
+	verboseResult            bool
+	statefulSetOnly          bool
+	resourceMultiplier       float64
+	maxPatchOps              int
+	maxPatchOpsWarnOnly      bool
+	logDiffSummary           bool
+	logSampleRate            int
+	echoPod                  bool
 	//requireAnnotation bool
 )
 
-type config struct {
-	Pods []corev1.Pod `json:"Pods"`
-}
-
 func main() {
 	var parameters WhSvrParameters
+	var logLevel int
+	var check bool
+	var emitEvents bool
+	var insecureHTTP bool
+	var readyCheckAPIServer bool
+	var checkNodeAllocatable bool
+	var printConfig bool
+	var podFile string
 
 	// get command line parameters
 	flag.IntVar(&parameters.port, "port", 443, "Webhook server port.")
 	flag.StringVar(&parameters.certFile, "tlsCertFile", "/etc/webhook/certs/cert.pem", "File containing the x509 Certificate for HTTPS.")
 	flag.StringVar(&parameters.keyFile, "tlsKeyFile", "/etc/webhook/certs/key.pem", "File containing the x509 private key to --tlsCertFile.")
+	flag.StringVar(&parameters.certDir, "tlsCertDir", "", "Directory containing tls.crt and tls.key; -tlsCertFile and -tlsKeyFile take precedence.")
+	flag.BoolVar(&insecureHTTP, "insecureHTTP", false, "Serve plain HTTP without loading certificates, e.g. behind a TLS-terminating sidecar; disables /reload and can't be combined with -clientCAFile.")
+	flag.StringVar(&parameters.clientCAFile, "clientCAFile", "", "File containing the CA certificates for verifying client certificates; /mutate requires one when set.")
+	flag.DurationVar(&parameters.requestTimeout, "requestTimeout", 10*time.Second, "Deadline for handling a single admission request.")
+	flag.BoolVar(&enabled, "enabled", true, "Mutate pods; when false every pod is admitted unchanged.")
+	flag.StringVar(&disableFile, "disableFile", "", "File whose existence disables mutation, as -enabled=false does, without a restart.")
 	flag.StringVar(&annotation, "annotation", defaultAnnotation, "The annotation to trigger initialization")
+	flag.StringVar(&admissionWebhookAnnotationStatusKey, "statusAnnotationKey", defaultAnnotationStatusKey, "The annotation key recording the mutation status.")
+	flag.BoolVar(&writeStatusAnnotation, "writeStatusAnnotation", true, "Add the status annotation to mutated pods.")
+	flag.StringVar(&versionAnnotationKey, "versionAnnotationKey", "", "Annotation key recording the webhook version on mutated pods, e.g. pod-modifier.solace.com/webhook-version; not written if empty.")
+	flag.Var((*stringList)(&ignoredNamespaces), "ignoredNamespaces", "Comma separated namespaces never mutated; entries wrapped in slashes, e.g. /istio-.*/, are regular expressions. Setting it replaces the kube-system and kube-public defaults.")
+	flag.BoolVar(&statefulSetOnly, "statefulSetOnly", false, "Skip pods controlled by anything but a StatefulSet; pods without a controller are still mutated when a config entry names them.")
+	flag.StringVar(&configFile, "configFile", "", "File containing the pod definitions used for pods without the podDefinition annotation.")
+	flag.StringVar(&configURL, "configURL", "", "URL the config used when a pod has no podDefinition annotation is fetched from; replaces the -configFile config once fetched.")
+	flag.DurationVar(&configRefresh, "configRefresh", time.Minute, "Interval at which the -configURL config is fetched again.")
+	flag.BoolVar(&strictContainerMatch, "strictContainerMatch", false, "Deny pods when a config container matches none of the pod's containers.")
+	flag.Float64Var(&resourceMultiplier, "resourceMultiplier", 1, "Factor applied to the resource limits and requests set by the config, e.g. 1.5 for load tests.")
+	flag.BoolVar(&allowEphemeralContainers, "allowEphemeralContainers", false, "Add the config's ephemeral containers to matched pods, e.g. for debugging. The API server rejects them when a pod is created.")
+	flag.StringVar(&warnLevel, "warnLevel", warnLevelWarning, "Messages returned as admission warnings: 'warning', or 'info' to include informational ones.")
+	flag.BoolVar(&prettyResponse, "prettyResponse", false, "Indent the AdmissionReview JSON returned by /mutate, for debugging.")
+	flag.BoolVar(&verboseResult, "verboseResult", false, "Set a success status with a message on responses carrying a patch.")
+	flag.IntVar(&maxConfigPods, "maxConfigPods", 1000, "Maximum number of config pods accepted; 0 for no limit.")
+	flag.IntVar(&maxPatchOps, "maxPatchOps", 0, "Deny pods whose patch has more operations than this; no limit if 0.")
+	flag.BoolVar(&maxPatchOpsWarnOnly, "maxPatchOpsWarnOnly", false, "Only warn when a patch exceeds -maxPatchOps instead of denying the pod.")
+	flag.BoolVar(&emitEvents, "emitEvents", false, "Record a PodModified event on mutated pods; requires access to the API server.")
+	flag.BoolVar(&readyCheckAPIServer, "readyCheckAPIServer", false, "Report not ready on /readyz while the API server's /healthz is unreachable.")
+	flag.BoolVar(&logDiffSummary, "logDiffSummary", false, "Log a readable summary of the changes made to each patched pod.")
+	flag.IntVar(&logSampleRate, "logSampleRate", 1, "Log only one of every N request info lines with the same message and outcome, whatever the pod, to cut noise during mass rollouts. Patches and denials are always logged.")
+	flag.BoolVar(&checkNodeAllocatable, "checkNodeAllocatable", false, "Warn when a mutated pod requests more resources than any node can allocate; requires listing nodes.")
+	flag.IntVar(&logLevel, "logLevel", -1, "Log verbosity level; overrides glog's -v when set. Request bodies are logged from level 6.")
+	flag.BoolVar(&printConfig, "printConfig", false, "Log the resolved flags and config at startup, with secrets redacted.")
+	flag.BoolVar(&echoPod, "echoPod", false, "Testing only: admit every pod unchanged with a warning naming the decoded pod and its containers.")
+	flag.BoolVar(&check, "check", false, "Print the patch for the pod in -podFile and exit without starting the server.")
+	flag.StringVar(&podFile, "podFile", "", "File containing the pod YAML used by -check.")
 	flag.Parse()
+	if err := setFlagsFromEnv(flag.CommandLine, envPrefix); err != nil {
+		glog.Fatalf("Failed to apply environment configuration: %v", err)
+	}
 
-	pair, err := tls.LoadX509KeyPair(parameters.certFile, parameters.keyFile)
+	if parameters.certDir != "" {
+		explicit := map[string]bool{}
+		flag.Visit(func(f *flag.Flag) {
+			explicit[f.Name] = true
+		})
+		parameters.certFile, parameters.keyFile = certPaths(parameters.certDir,
+			parameters.certFile, explicit["tlsCertFile"], parameters.keyFile, explicit["tlsKeyFile"])
+	}
+
+	var err error
+	if ignoredNamespaceMatchers, err = namespaceMatchers(ignoredNamespaces); err != nil {
+		glog.Fatalf("Invalid -ignoredNamespaces: %v", err)
+	}
+
+	if warnLevel != warnLevelWarning && warnLevel != warnLevelInfo {
+		glog.Errorf("Unknown -warnLevel %q, using %q", warnLevel, warnLevelWarning)
+		warnLevel = warnLevelWarning
+	}
+
+	if resourceMultiplier <= 0 {
+		glog.Errorf("Invalid -resourceMultiplier %v, using 1", resourceMultiplier)
+		resourceMultiplier = 1
+	}
+
+	if logLevel >= 0 {
+		if err := flag.Set("v", strconv.Itoa(logLevel)); err != nil {
+			glog.Errorf("Failed to set log level: %v", err)
+		}
+	}
+
+	if configFile != "" {
+		if _, err := loadConfigFile(configFile); err != nil {
+			glog.Errorf("Failed to load config file: %v", err)
+		}
+	}
+
+	var fetcher *configFetcher
+	if configURL != "" {
+		fetcher = newConfigFetcher(configURL)
+		if _, err := fetcher.fetch(); err != nil {
+			glog.Errorf("Failed to fetch config: %v", err)
+		}
+	}
+
+	if printConfig {
+		if dump, err := configDump(flag.CommandLine); err != nil {
+			glog.Errorf("Failed to print config: %v", err)
+		} else {
+			glog.Infof("Resolved configuration:\n%s", dump)
+		}
+	}
+
+	if check {
+		if err := runCheck(podFile, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			glog.Flush()
+			os.Exit(1)
+		}
+		glog.Flush()
+		return
+	}
+
+	if err := checkTLSFlags(insecureHTTP, parameters.clientCAFile); err != nil {
+		glog.Fatalf("Invalid flags: %v", err)
+	}
+
+	whsvr, err := newWebhookServer(parameters, insecureHTTP)
 	if err != nil {
-		glog.Errorf("Filed to load key pair: %v", err)
+		glog.Fatalf("Failed to configure client certificate verification: %v", err)
 	}
+	whsvr.readyCheckAPI = readyCheckAPIServer
 
-	whsvr := &WebhookServer{
-		server: &http.Server{
-			Addr:      fmt.Sprintf(":%v", parameters.port),
-			TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}},
-		},
+	if emitEvents || readyCheckAPIServer || checkNodeAllocatable {
+		client, err := newKubeClient()
+		if err != nil {
+			glog.Errorf("Failed to create API server client, client-backed features are disabled: %v", err)
+		} else {
+			whsvr.client = client
+			if emitEvents {
+				whsvr.recorder = newEventRecorder(client)
+			}
+			if checkNodeAllocatable {
+				go refreshNodeAllocatable(client)
+			}
+		}
 	}
 
-	// define http server and server handler
-	mux := http.NewServeMux()
-	mux.HandleFunc("/mutate", whsvr.serve)
-	whsvr.server.Handler = mux
+	if fetcher != nil && configRefresh > 0 {
+		go fetcher.run(configRefresh)
+	}
 
 	// start webhook server in new rountine
 	go func() {
-		if err := whsvr.server.ListenAndServeTLS("", ""); err != nil {
+		if err := whsvr.listenAndServe(); err != nil {
 			glog.Errorf("Filed to listen and serve webhook server: %v", err)
 		}
 	}()
@@ -67,5 +214,200 @@ func main() {
 	<-signalChan
 
 	glog.Infof("Got OS shutdown signal, shutting down wenhook server gracefully...")
-	whsvr.server.Shutdown(context.Background())
+	shutdown(whsvr.server, glog.Flush)
+}
+
+// Comma separated list flag value
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// Set every flag not given on the command line from its environment variable,
+// e.g. -tlsCertFile from WEBHOOK_TLS_CERT_FILE
+func setFlagsFromEnv(fs *flag.FlagSet, prefix string) error {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if explicit[f.Name] || err != nil {
+			return
+		}
+		name := prefix + envName(f.Name)
+		if value, ok := os.LookupEnv(name); ok {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", value, name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// Convert a camel case flag name to an upper snake case variable name. A run of
+// capitals is a word of its own, e.g. -clientCAFile is CLIENT_CA_FILE.
+func envName(flagName string) string {
+	runes := []rune(flagName)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			prev := runes[i-1]
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				b.WriteByte('_')
+			}
+		}
+		if r == '-' || r == '.' {
+			r = '_'
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// Check the flags choosing how the webhook serves. Client certificates need TLS, so
+// -clientCAFile can't be combined with -insecureHTTP.
+func checkTLSFlags(insecureHTTP bool, clientCAFile string) error {
+	if insecureHTTP && clientCAFile != "" {
+		return fmt.Errorf("-clientCAFile requires TLS and can't be used with -insecureHTTP")
+	}
+	return nil
+}
+
+// Build the webhook server and its handler. With -insecureHTTP no certificates are loaded
+// and the server answers plain HTTP.
+func newWebhookServer(parameters WhSvrParameters, insecureHTTP bool) (*WebhookServer, error) {
+	var tlsConfig *tls.Config
+	if insecureHTTP {
+		glog.Warningf("Serving plain HTTP because of -insecureHTTP; TLS must be terminated in front of the webhook")
+	} else {
+		pair, err := tls.LoadX509KeyPair(parameters.certFile, parameters.keyFile)
+		if err != nil {
+			glog.Errorf("Filed to load key pair: %v", err)
+		}
+
+		tlsConfig, err = serverTLSConfig(pair, parameters.clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	whsvr := &WebhookServer{
+		server: &http.Server{
+			Addr:      fmt.Sprintf(":%v", parameters.port),
+			TLSConfig: tlsConfig,
+		},
+		requestTimeout:    parameters.requestTimeout,
+		requireClientCert: parameters.clientCAFile != "",
+		reloadDisabled:    insecureHTTP,
+		plainHTTP:         insecureHTTP,
+	}
+	whsvr.server.Handler = whsvr.handler()
+	return whsvr, nil
+}
+
+// Listen on the server's port and serve until the server is shut down
+func (whsvr *WebhookServer) listenAndServe() error {
+	ln, err := net.Listen("tcp", whsvr.server.Addr)
+	if err != nil {
+		return err
+	}
+	return whsvr.serveListener(ln)
+}
+
+// Serve the connections accepted on ln, over TLS unless the server answers plain HTTP
+func (whsvr *WebhookServer) serveListener(ln net.Listener) error {
+	if whsvr.plainHTTP {
+		return whsvr.server.Serve(ln)
+	}
+	return whsvr.server.ServeTLS(ln, "", "")
+}
+
+// Derive the certificate and key paths from the certificate directory,
+// unless the file was set explicitly
+func certPaths(certDir string, certFile string, certFileSet bool, keyFile string, keyFileSet bool) (string, string) {
+	if !certFileSet {
+		certFile = filepath.Join(certDir, "tls.crt")
+	}
+	if !keyFileSet {
+		keyFile = filepath.Join(certDir, "tls.key")
+	}
+	return certFile, keyFile
+}
+
+// Build the server TLS config. With a client CA file, client certificates are verified
+// against its CAs, e.g. the API server's client certificate. The handshake only asks for a
+// certificate instead of requiring one with tls.RequireAndVerifyClientCert: readiness probes
+// of /readyz and Prometheus scrapes of /metrics come without one and would fail the
+// handshake. serve rejects /mutate requests without a verified certificate instead.
+func serverTLSConfig(pair tls.Certificate, clientCAFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{pair}}
+	if clientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	caPEM, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return tlsConfig, err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return tlsConfig, fmt.Errorf("no certificates found in %s", clientCAFile)
+	}
+	tlsConfig.ClientCAs = clientCAs
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return tlsConfig, nil
+}
+
+// Stop the server, waiting for in-flight requests, then flush the buffered logs so the
+// last lines aren't lost when the process exits
+func shutdown(server *http.Server, flush func()) {
+	if err := server.Shutdown(context.Background()); err != nil {
+		glog.Errorf("Failed to shut down webhook server: %v", err)
+	}
+	flush()
+}
+
+// Describe the resolved flags and the loaded config for -printConfig. URL credentials and
+// env values that look like secrets are redacted.
+func configDump(fs *flag.FlagSet) (string, error) {
+	var b strings.Builder
+	b.WriteString("flags:\n")
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if u, err := url.Parse(value); err == nil && u.User != nil {
+			value = u.Redacted()
+		}
+		fmt.Fprintf(&b, "  %s: %q\n", f.Name, value)
+	})
+
+	c, loaded := currentFileConfig()
+	if !loaded {
+		b.WriteString("config: none loaded\n")
+		return b.String(), nil
+	}
+	data, err := yaml.Marshal(redactConfig(c))
+	if err != nil {
+		return "", err
+	}
+	b.WriteString("config:\n")
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		b.WriteString("  " + line + "\n")
+	}
+	return b.String(), nil
 }
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// size of the JSON patches returned to the API server
+	patchBytesHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "webhook_patch_bytes",
+		Help:    "Size in bytes of the JSON patches returned by the webhook.",
+		Buckets: prometheus.ExponentialBuckets(64, 2, 10),
+	})
+
+	// reviewed pods, by whether they were patched
+	mutationsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_mutations_total",
+		Help: "Number of pods reviewed by the webhook, labeled by whether the response patched them.",
+	}, []string{"patched"})
+)
+
+func init() {
+	prometheus.MustRegister(patchBytesHistogram, mutationsCounter)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/morvencao/kube-mutating-webhook-tutorial/pkg/mutation"
+)
+
+const (
+	configFetchTimeout = 10 * time.Second
+
+	// largest config accepted from -configURL
+	maxConfigBytes = 10 << 20
+)
+
+// Fetches the config from a URL. The ETag of the last good response is sent along, so an
+// unchanged config isn't downloaded and parsed again.
+type configFetcher struct {
+	url    string
+	client *http.Client
+	etag   string
+}
+
+func newConfigFetcher(url string) *configFetcher {
+	return &configFetcher{
+		url:    url,
+		client: &http.Client{Timeout: configFetchTimeout},
+	}
+}
+
+// Fetch the config and store it, returning false if it is unchanged. On failure the
+// config loaded last stays in use. The config has a slot of its own, so a /reload of
+// the -configFile can't leave the ETag pointing at a config no longer in use.
+func (f *configFetcher) fetch() (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, f.url, nil)
+	if err != nil {
+		return false, err
+	}
+	if f.etag != "" {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("could not fetch config %s: %v", f.url, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return false, nil
+	case http.StatusOK:
+	default:
+		return false, fmt.Errorf("could not fetch config %s: %s", f.url, resp.Status)
+	}
+
+	// read one byte past the limit to tell a config of exactly the limit from a longer one
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxConfigBytes+1))
+	if err != nil {
+		return false, fmt.Errorf("could not read config %s: %v", f.url, err)
+	}
+	if len(data) > maxConfigBytes {
+		return false, fmt.Errorf("config %s exceeds %d bytes", f.url, maxConfigBytes)
+	}
+	c, err := mutation.ParseConfig(data)
+	if err != nil {
+		return false, fmt.Errorf("could not parse config %s: %v", f.url, err)
+	}
+	if err := storeConfig(&urlConfig, f.url, c); err != nil {
+		return false, err
+	}
+	f.etag = resp.Header.Get("ETag")
+	glog.Infof("Loaded config %s with %d pods", f.url, len(c.Pods))
+	return true, nil
+}
+
+// Fetch the config every interval, forever
+func (f *configFetcher) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := f.fetch(); err != nil {
+			glog.Errorf("Config refresh failed, keeping the last loaded config: %v", err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConfigFetcher(t *testing.T) {
+	defer urlConfig.Store(nil)
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case failing:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		case r.Header.Get("If-None-Match") == `"v1"`:
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte(brokerConfig))
+		}
+	}))
+	defer server.Close()
+	f := newConfigFetcher(server.URL)
+	pod := testPod("broker-0", "", "broker")
+
+	if changed, err := f.fetch(); err != nil || !changed {
+		t.Fatalf("expected the config to be loaded, got %t and %v", changed, err)
+	}
+	if response := review(t, pod); !strings.Contains(string(response.Patch), `"broker:2"`) {
+		t.Fatalf("expected the fetched config to apply, got %s", response.Patch)
+	}
+
+	// the ETag is sent along and the unchanged config is kept
+	if changed, err := f.fetch(); err != nil || changed {
+		t.Fatalf("expected the cached config to be kept, got %t and %v", changed, err)
+	}
+
+	failing = true
+	if _, err := f.fetch(); err == nil {
+		t.Fatal("expected an error when the server fails")
+	}
+	if response := review(t, pod); !strings.Contains(string(response.Patch), `"broker:2"`) {
+		t.Fatalf("expected the last good config to still apply, got %s", response.Patch)
+	}
+}
+
+func TestConfigFetcherAfterReload(t *testing.T) {
+	defer func(path string) { configFile = path }(configFile)
+	defer fileConfig.Store(nil)
+	defer urlConfig.Store(nil)
+	configFile = writeConfigFile(t, strings.Replace(brokerConfig, "broker:2", "broker:3", 1))
+	if _, err := loadConfigFile(configFile); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(brokerConfig))
+	}))
+	defer server.Close()
+	f := newConfigFetcher(server.URL)
+	pod := testPod("broker-0", "", "broker")
+
+	if _, err := f.fetch(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(configFile, []byte(strings.Replace(brokerConfig, "broker:2", "broker:4", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if rec := reloadFrom("127.0.0.1:40000"); rec.Code != http.StatusOK {
+		t.Fatalf("expected the reload to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// the server answers 304 for the ETag, the fetched config must still be the one applied
+	if changed, err := f.fetch(); err != nil || changed {
+		t.Fatalf("expected the cached config to be kept, got %t and %v", changed, err)
+	}
+	if response := review(t, pod); !strings.Contains(string(response.Patch), `"broker:2"`) {
+		t.Fatalf("expected the fetched config to take precedence over the reloaded file, got %s", response.Patch)
+	}
+}
+
+func TestConfigFetcherTooLarge(t *testing.T) {
+	defer urlConfig.Store(nil)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a valid config padded past the limit with a trailing comment
+		w.Write([]byte(brokerConfig + "#" + strings.Repeat("x", maxConfigBytes)))
+	}))
+	defer server.Close()
+
+	if _, err := newConfigFetcher(server.URL).fetch(); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Fatalf("expected an error for a config over %d bytes, got %v", maxConfigBytes, err)
+	}
+	if _, loaded := currentFileConfig(); loaded {
+		t.Fatal("expected the oversized config not to be loaded")
+	}
+}
@@ -1,18 +1,29 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	glog "github.com/golang/glog"
-	"github.com/mattbaird/jsonpatch"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/morvencao/kube-mutating-webhook-tutorial/pkg/mutation"
 )
 
 var (
@@ -24,33 +35,75 @@ var (
 	defaulter = runtime.ObjectDefaulter(runtimeScheme)
 )
 
+func init() {
+	_ = corev1.AddToScheme(runtimeScheme)
+}
+
 var ignoredNamespaces = []string{
 	metav1.NamespaceSystem,
 	metav1.NamespacePublic,
 }
 
-const (
-	admissionWebhookAnnotationInjectKey = "pod-modifier-webhook.solace.com/inject"
-	admissionWebhookAnnotationStatusKey = "pod-modifier-webhook.solace.com/status"
-)
+// matchers for ignoredNamespaces, compiled once the flags are parsed
+var ignoredNamespaceMatchers []func(string) bool
+
+const defaultAnnotationStatusKey = "pod-modifier-webhook.solace.com/status"
+
+var admissionWebhookAnnotationStatusKey = defaultAnnotationStatusKey
+
+// admission reviews larger than this are rejected
+const maxRequestBodyBytes = 10 << 20
 
 type WebhookServer struct {
-	server *http.Server
+	server         *http.Server
+	requestTimeout time.Duration
+	recorder       record.EventRecorder // records events on mutated pods, nil if disabled
+	client         kubernetes.Interface // API server client, nil if no client-backed feature is enabled
+	readyCheckAPI  bool                 // readiness requires a reachable API server
+
+	requireClientCert bool // /mutate requires a client certificate verified against -clientCAFile
+	reloadDisabled    bool // /reload is refused, behind a TLS-terminating proxy every request comes from localhost
+	plainHTTP         bool // serves plain HTTP without certificates, with -insecureHTTP
 }
 
 // Webhook Server parameters
 type WhSvrParameters struct {
-	port     int    // webhook server port
-	certFile string // path to the x509 certificate for https
-	keyFile  string // path to the x509 private key matching `CertFile`
+	port           int           // webhook server port
+	certFile       string        // path to the x509 certificate for https
+	keyFile        string        // path to the x509 private key matching `CertFile`
+	certDir        string        // directory with tls.crt and tls.key, used for the paths not set explicitly
+	clientCAFile   string        // path to the CA certificates for verifying client certificates
+	requestTimeout time.Duration // deadline for handling a single admission request
 }
 
 // Check whether the target resoured need to be mutated
-func mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta) bool {
+func mutationRequired(logger requestLogger, ignoredList []func(string) bool, metadata *metav1.ObjectMeta) bool {
 	// skip special kubernete system namespaces
-	for _, namespace := range ignoredList {
-		if metadata.Namespace == namespace {
-			glog.Infof("Skip mutation for %v for it' in special namespace:%v", metadata.Name, metadata.Namespace)
+	for _, matches := range ignoredList {
+		if matches(metadata.Namespace) {
+			logger.Outcomef(outcomeSkipped, "Skip mutation for %v for it' in special namespace:%v", metadata.Name, metadata.Namespace)
+			return false
+		}
+	}
+
+	// pods without a controller, e.g. from kubectl run, are left to the config entries naming them
+	if statefulSetOnly {
+		if owner := metav1.GetControllerOf(metadata); owner != nil && owner.Kind != "StatefulSet" {
+			logger.Outcomef(outcomeSkipped, "Skip mutation for %v/%v, it is controlled by a %s, not a StatefulSet", metadata.Namespace, metadata.Name, owner.Kind)
+			return false
+		}
+	}
+	return true
+}
+
+// Check the -enabled kill switch, and the -disableFile toggle that turns the webhook off
+// while the file exists
+func mutationEnabled() bool {
+	if !enabled {
+		return false
+	}
+	if disableFile != "" {
+		if _, err := os.Stat(disableFile); err == nil {
 			return false
 		}
 	}
@@ -58,133 +111,367 @@ func mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta) bool {
 }
 
 // main mutation process
-func (whsvr *WebhookServer) mutate(ar *v1.AdmissionReview) *v1.AdmissionResponse {
+func (whsvr *WebhookServer) mutate(ctx context.Context, ar *v1.AdmissionReview) *v1.AdmissionResponse {
 	req := ar.Request
+	if req == nil {
+		glog.Error("AdmissionReview has no request")
+		return denyResponse("admission review has no request")
+	}
+
+	logger := requestLogger{uid: req.UID, warnings: &[]string{}}
+	var response *v1.AdmissionResponse
+	if mutationEnabled() {
+		response = whsvr.admit(ctx, logger, req)
+		response.Warnings = logger.responseWarnings()
+	} else {
+		logger.Infof("Webhook disabled, admitting %s/%s unchanged", req.Namespace, req.Name)
+		response = &v1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+	// every reviewed pod is counted, skipped and denied ones as not patched
+	mutationsCounter.WithLabelValues(strconv.FormatBool(len(response.Patch) > 0)).Inc()
+	return response
+}
+
+// Admit the pod of the request, patching it if a config entry matches
+func (whsvr *WebhookServer) admit(ctx context.Context, logger requestLogger, req *v1.AdmissionRequest) *v1.AdmissionResponse {
 	var pod corev1.Pod
 	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
-		glog.Errorf("Could not unmarshal raw object: %v", err)
-		return &v1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
+		logger.Errorf("Could not unmarshal raw object: %v", err)
+		return denyResponse(err.Error())
+	}
+
+	// the pod in a CREATE request may not carry its namespace yet
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
 	}
 
-	glog.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v",
+	logger.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v",
 		req.Kind, req.Namespace, req.Name, pod.Name, req.UID, req.Operation, req.UserInfo)
 
+	if echoPod {
+		names := make([]string, 0, len(pod.Spec.Containers))
+		for _, c := range pod.Spec.Containers {
+			names = append(names, c.Name)
+		}
+		logger.Warningf("echo: decoded pod %s/%s with containers [%s]", pod.Namespace, pod.Name, strings.Join(names, ", "))
+		return &v1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
 	// determine whether to perform mutation
-	if !mutationRequired(ignoredNamespaces, &pod.ObjectMeta) {
-		glog.Infof("Skipping mutation for %s/%s due to policy check", pod.Namespace, pod.Name)
+	if !mutationRequired(logger, ignoredNamespaceMatchers, &pod.ObjectMeta) {
+		logger.Outcomef(outcomeSkipped, "Skipping mutation for %s/%s due to policy check", pod.Namespace, pod.Name)
 		return &v1.AdmissionResponse{
 			Allowed: true,
 		}
 	}
 
-	patchBytes, err := createPatch(&pod)
+	patchBytes, err := createPatch(ctx, logger, &pod, req.Object.Raw)
 	if err != nil {
+		response := denyResponse(err.Error())
+		if verr, ok := err.(*mutation.ValidationError); ok {
+			response.Result.Reason = metav1.StatusReasonInvalid
+			response.Result.Details = &metav1.StatusDetails{
+				Name:   pod.Name,
+				Kind:   "Pod",
+				Causes: verr.Causes,
+			}
+		}
+		return response
+	}
+
+	if maxPatchOps > 0 {
+		var ops []json.RawMessage
+		if err := json.Unmarshal(patchBytes, &ops); err == nil && len(ops) > maxPatchOps {
+			if !maxPatchOpsWarnOnly {
+				logger.Errorf("Patch for pod %s/%s has %d operations, more than %d", pod.Namespace, pod.Name, len(ops), maxPatchOps)
+				return denyResponse(fmt.Sprintf("patch has %d operations, more than the allowed %d", len(ops), maxPatchOps))
+			}
+			logger.Warningf("Patch for pod %s/%s has %d operations, more than %d", pod.Namespace, pod.Name, len(ops), maxPatchOps)
+		}
+	}
+
+	if len(patchBytes) == 0 {
+		logger.Outcomef(outcomeNoChanges, "AdmissionResponse: no changes for %s/%s", pod.Namespace, pod.Name)
 		return &v1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
+			Allowed: true,
 		}
 	}
 
-	glog.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
-	return &v1.AdmissionResponse{
+	patchBytesHistogram.Observe(float64(len(patchBytes)))
+	logger.Info("AdmissionResponse: patch=", string(patchBytes))
+	annotations := auditAnnotations(patchBytes)
+	if whsvr.recorder != nil {
+		// the paths only, the full patch may be too large for an event
+		whsvr.recorder.Eventf(&pod, corev1.EventTypeNormal, "PodModified", "Pod modified by %s: %s", eventComponent, annotations["patched-paths"])
+	}
+	response := &v1.AdmissionResponse{
 		Allowed: true,
 		Patch:   patchBytes,
 		PatchType: func() *v1.PatchType {
 			pt := v1.PatchTypeJSONPatch
 			return &pt
 		}(),
+		AuditAnnotations: annotations,
+	}
+	if verboseResult {
+		response.Result = &metav1.Status{
+			Status:  metav1.StatusSuccess,
+			Message: fmt.Sprintf("pod %s/%s modified by %s", pod.Namespace, pod.Name, eventComponent),
+		}
 	}
+	return response
 }
 
-func createPatch(pod *corev1.Pod) ([]byte, error) {
-	glog.Infof("Create patch for pod: %s/%s", pod.Name, pod.Namespace)
-
-	initializedPod := pod.DeepCopy()
+// Compile the ignored namespace entries
+func namespaceMatchers(namespaces []string) ([]func(string) bool, error) {
+	matchers := make([]func(string) bool, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		matches, err := mutation.NameMatcher(namespace)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, matches)
+	}
+	return matchers, nil
+}
 
-	a := pod.ObjectMeta.GetAnnotations()
-	podDefinitionAnnotation, ok := a[annotation+".podDefinition"]
+// Build the response denying a request. It never carries a patch.
+func denyResponse(msg string) *v1.AdmissionResponse {
+	return &v1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: msg,
+		},
+	}
+}
 
-	if !ok {
-		glog.Infof("Required '%s' annotation missing; skipping pod", annotation+".podDefinition")
-		return []byte{}, nil
+// Build the audit annotations describing a patch. The API server prefixes
+// the keys with the webhook name, so they are left unqualified here.
+func auditAnnotations(patchBytes []byte) map[string]string {
+	var ops []struct {
+		Path string `json:"path"`
+	}
+	if len(patchBytes) == 0 || json.Unmarshal(patchBytes, &ops) != nil || len(ops) == 0 {
+		return nil
 	}
 
-	var c config
-	err := json.Unmarshal([]byte(podDefinitionAnnotation), &c)
-	if err != nil {
-		glog.Errorf("Unmarshal failed err %v  ,  Annotation %s", err, podDefinitionAnnotation)
-		return []byte{}, err
+	paths := make([]string, 0, len(ops))
+	for _, op := range ops {
+		paths = append(paths, op.Path)
 	}
+	return map[string]string{
+		"matched":       "true",
+		"patched-paths": strings.Join(paths, ","),
+	}
+}
 
-	var cpod corev1.Pod
-	found := false
-	for _, cpod = range c.Pods {
-		if pod.ObjectMeta.Name == cpod.ObjectMeta.Name {
-			found = true
-			break
-		}
+// Create the patch for the pod from its podDefinition annotations or the config file.
+// raw is the pod as sent by the API server, the patch only holds changes against it.
+func createPatch(ctx context.Context, logger requestLogger, pod *corev1.Pod, raw []byte) ([]byte, error) {
+	logger.Infof("Create patch for pod: %s/%s", pod.Name, pod.Namespace)
+
+	if err := ctx.Err(); err != nil {
+		logger.Errorf("Request for pod %s/%s expired before patching: %v", pod.Namespace, pod.Name, err)
+		return []byte{}, err
 	}
 
-	if !found {
-		glog.Infof("Pod name is not matching annotation - skipping this pod.")
+	a := pod.ObjectMeta.GetAnnotations()
+	if skip, _ := strconv.ParseBool(a[annotation+".skip"]); skip {
+		logger.Noticef(outcomeSkipped, "Pod %s/%s opted out with '%s' annotation; skipping pod", pod.Namespace, pod.Name, annotation+".skip")
 		return []byte{}, nil
 	}
 
-	// Modify the containers resources, if the container name of the specification matches
-	// the conainer name of the "initialized pod container name"
-	// Then patch the original pod
-	found = false
-	for _, configContainer := range cpod.Spec.Containers {
-		for ii, initializedContainer := range initializedPod.Spec.Containers {
-			if configContainer.Name == initializedContainer.Name {
-				initializedPod.Spec.Containers[ii].Resources = configContainer.Resources
-				found = true
+	podDefinitionAnnotations := podDefinitions(logger, a)
+
+	c := &mutation.Config{}
+	if len(podDefinitionAnnotations) > 0 {
+		for _, podDefinitionAnnotation := range podDefinitionAnnotations {
+			if err := cachedParseFailure(podDefinitionAnnotation); err != nil {
+				if logger.V(2) {
+					logger.Infof("Unmarshal failed earlier for the same annotation: %v", err)
+				}
+				return []byte{}, err
+			}
+			ac, err := mutation.ParsePodDefinition([]byte(podDefinitionAnnotation))
+			if err != nil {
+				logger.Errorf("Unmarshal failed err %v  ,  Annotation %s", err, podDefinitionAnnotation)
+				recordParseFailure(podDefinitionAnnotation, err)
+				return []byte{}, err
+			}
+			c.Pods = append(c.Pods, ac.Pods...)
+			for name, profile := range ac.Profiles {
+				if c.Profiles == nil {
+					c.Profiles = map[string]corev1.ResourceRequirements{}
+				}
+				c.Profiles[name] = profile
+			}
+			if maxConfigPods > 0 && len(c.Pods) > maxConfigPods {
+				err := fmt.Errorf("podDefinition annotations hold more than %d pods", maxConfigPods)
+				logger.Error(err)
+				return []byte{}, err
 			}
 		}
-	}
-	if !found {
-		glog.Infof("No container name is matching annotation - skipping this pod.")
+	} else if fc, loaded := lookupConfig(ctx); loaded {
+		c = fc
+	} else if err := ctx.Err(); err != nil {
+		// the lookup gave up on the deadline, that is no reason to admit the pod unchanged
+		logger.Errorf("Request for pod %s/%s expired looking up the config: %v", pod.Namespace, pod.Name, err)
+		return []byte{}, err
+	} else {
+		logger.Outcomef(outcomeSkipped, "Required '%s' annotation missing; skipping pod", annotation+".podDefinition")
 		return []byte{}, nil
 	}
 
-	oldData, err := json.Marshal(pod)
-	if err != nil {
-		glog.Error(err)
+	if err := ctx.Err(); err != nil {
+		logger.Errorf("Request for pod %s/%s expired before patching: %v", pod.Namespace, pod.Name, err)
 		return []byte{}, err
 	}
 
-	newData, err := json.Marshal(initializedPod)
-	if err != nil {
-		glog.Error(err)
-		return []byte{}, err
+	result, err := mutation.Mutate(pod, raw, c, mutationOptions(logger))
+	for _, warning := range result.Warnings {
+		logger.addWarning(warning)
 	}
-	patch, err := jsonpatch.CreatePatch(oldData, newData)
-	if err != nil {
-		glog.Error(err)
-		return []byte{}, err
+	return result.Patch, err
+}
+
+// Options for applying the config to the request's pod, from the flags
+func mutationOptions(logger requestLogger) mutation.Options {
+	opts := mutation.Options{
+		StrictContainerMatch:     strictContainerMatch,
+		WriteStatusAnnotation:    writeStatusAnnotation,
+		StatusAnnotationKey:      admissionWebhookAnnotationStatusKey,
+		VersionAnnotationKey:     versionAnnotationKey,
+		Version:                  version,
+		AllowEphemeralContainers: allowEphemeralContainers,
+		ResourceMultiplier:       resourceMultiplier,
+		LogDiffSummary:           logDiffSummary,
+		NoticesAsWarnings:        warnLevel == warnLevelInfo,
+		// the mutation returns its warnings, so the logger passed on doesn't collect them.
+		// Its lines, the diff summary among them, describe a single pod and are never sampled.
+		Logger: requestLogger{uid: logger.uid, unsampled: true},
 	}
+	if nodes := nodeAllocatable.Load(); nodes != nil {
+		opts.NodeAllocatable = *nodes
+	}
+	return opts
+}
+
+// Handler for all webhook server endpoints, the whole admission path can be served from it
+func (whsvr *WebhookServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mutate", whsvr.serve)
+	mux.HandleFunc("/reload", whsvr.reload)
+	mux.HandleFunc("/readyz", whsvr.readyz)
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+// Readiness method for webhook server, optionally requires the API server to be reachable
+func (whsvr *WebhookServer) readyz(w http.ResponseWriter, r *http.Request) {
+	if whsvr.readyCheckAPI {
+		if whsvr.client == nil {
+			http.Error(w, "no API server client", http.StatusServiceUnavailable)
+			return
+		}
+		// as for admission requests, a zero timeout sets no deadline
+		ctx := r.Context()
+		if whsvr.requestTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, whsvr.requestTimeout)
+			defer cancel()
+		}
+		if err := pingAPIServer(ctx, whsvr.client); err != nil {
+			glog.Warningf("Readiness check failed, API server unreachable: %v", err)
+			http.Error(w, fmt.Sprintf("API server unreachable: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// Reload method for webhook server, re-reads the config file. Only accepted from localhost.
+func (whsvr *WebhookServer) reload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
 
-	patchBytes, err := json.Marshal(patch)
+	if whsvr.reloadDisabled {
+		glog.Errorf("Rejected config reload from %s, reload is disabled with -insecureHTTP", r.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "reload is disabled with -insecureHTTP"})
+		return
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+		glog.Errorf("Rejected config reload from %s", r.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "reload is only allowed from localhost"})
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "reload requires POST"})
+		return
+	}
+	if configFile == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "no config file configured"})
+		return
+	}
+
+	c, err := loadConfigFile(configFile)
 	if err != nil {
-		glog.Error(err)
-		return []byte{}, err
+		glog.Errorf("Config reload failed, keeping the previous config: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
 	}
 
-	return patchBytes, nil
+	glog.Infof("Reloaded config file %s with %d pods", configFile, len(c.Pods))
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "reloaded", "pods": len(c.Pods)})
 }
 
 // Serve method for webhook server
 func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
+	// probes check the endpoint answers without sending an AdmissionReview
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		glog.Errorf("Method=%s, expect POST", r.Method)
+		w.Header().Set("Allow", http.MethodPost+", "+http.MethodHead)
+		http.Error(w, "method not allowed, expect POST", http.StatusMethodNotAllowed)
+		return
+	}
+	// the TLS config only verifies certificates clients present, the other endpoints need none
+	if whsvr.requireClientCert && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		glog.Errorf("Rejected request from %s without a verified client certificate", r.RemoteAddr)
+		http.Error(w, "a verified client certificate is required", http.StatusForbidden)
+		return
+	}
+
 	var body []byte
 	if r.Body != nil {
-		if data, err := ioutil.ReadAll(r.Body); err == nil {
-			body = data
+		// the body is read until EOF, so chunked requests without a Content-Length are read fully up to the cap
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes))
+		if err != nil {
+			glog.Errorf("Can't read body: %v", err)
+			status := http.StatusBadRequest
+			if errors.As(err, new(*http.MaxBytesError)) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, fmt.Sprintf("could not read body: %v", err), status)
+			return
 		}
+		body = data
+	}
+	// bodies may hold secrets from env values, so they are only dumped for debugging
+	if glog.V(6) {
+		glog.Infof("Request body: %s", body)
 	}
 	if len(body) == 0 {
 		glog.Error("empty body")
@@ -204,16 +491,20 @@ func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
 	ar := v1.AdmissionReview{}
 	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
 		glog.Errorf("Can't decode body: %v", err)
-		admissionResponse = &v1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
+		admissionResponse = denyResponse(err.Error())
 	} else {
-		admissionResponse = whsvr.mutate(&ar)
+		ctx := r.Context()
+		if whsvr.requestTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, whsvr.requestTimeout)
+			defer cancel()
+		}
+		admissionResponse = whsvr.mutate(ctx, &ar)
 	}
 
-	admissionReview := v1.AdmissionReview{}
+	// the API server only accepts a response of the review version it sent
+	reviewType := metav1.TypeMeta{APIVersion: v1.SchemeGroupVersion.String(), Kind: "AdmissionReview"}
+	admissionReview := v1.AdmissionReview{TypeMeta: reviewType}
 	if admissionResponse != nil {
 		admissionReview.Response = admissionResponse
 		if ar.Request != nil {
@@ -221,14 +512,39 @@ func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	resp, err := json.Marshal(admissionReview)
+	marshal := json.Marshal
+	if prettyResponse {
+		marshal = func(v interface{}) ([]byte, error) {
+			return json.MarshalIndent(v, "", "  ")
+		}
+	}
+	resp, err := encodeReview(&admissionReview, marshal)
 	if err != nil {
-		glog.Errorf("Can't encode response: %v", err)
 		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
 	}
 	glog.Infof("Ready to write reponse ...")
+	w.Header().Set("Content-Type", "application/json")
 	if _, err := w.Write(resp); err != nil {
 		glog.Errorf("Can't write response: %v", err)
 		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
 	}
 }
+
+// Encode the review. If that fails the API server still needs a review carrying the
+// request UID, so a failure review is encoded in its place.
+func encodeReview(review *v1.AdmissionReview, marshal func(interface{}) ([]byte, error)) ([]byte, error) {
+	resp, err := marshal(review)
+	if err == nil {
+		return resp, nil
+	}
+	glog.Errorf("Can't encode response: %v", err)
+	failure := v1.AdmissionReview{
+		TypeMeta: review.TypeMeta,
+		Response: denyResponse(fmt.Sprintf("could not encode response: %v", err)),
+	}
+	if review.Response != nil {
+		failure.Response.UID = review.Response.UID
+	}
+	return json.Marshal(failure)
+}
@@ -0,0 +1,791 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/morvencao/kube-mutating-webhook-tutorial/pkg/mutation"
+)
+
+const testUID = "0df28fbd-5f5f-11e8-bc74-36e6bb280816"
+
+// config entry replacing the image of the broker container of broker-0
+const brokerDefinition = `{"Pods":[{"metadata":{"name":"broker-0"},"spec":{"containers":[{"name":"broker","image":"broker:2"}]}}]}`
+
+func TestMain(m *testing.M) {
+	// the flag defaults, as main would set them
+	enabled = true
+	annotation = defaultAnnotation
+	ignoredNamespaceMatchers, _ = namespaceMatchers(ignoredNamespaces)
+	os.Exit(m.Run())
+}
+
+// Build a pod in the default namespace with the podDefinition annotation and containers of the given names
+func testPod(name string, definition string, containers ...string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+	}
+	if definition != "" {
+		pod.Annotations = map[string]string{annotation + ".podDefinition": definition}
+	}
+	for _, c := range containers {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: c, Image: c + ":1"})
+	}
+	return pod
+}
+
+// Build the AdmissionReview the API server sends for creating the pod
+func reviewBody(t *testing.T, pod *corev1.Pod) []byte {
+	t.Helper()
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(v1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &v1.AdmissionRequest{
+			UID:       testUID,
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Namespace: pod.Namespace,
+			Name:      pod.Name,
+			Operation: v1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// Post the body to /mutate of the server's handler
+func post(whsvr *WebhookServer, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	whsvr.handler().ServeHTTP(rec, req)
+	return rec
+}
+
+// Decode the AdmissionReview of a /mutate response
+func decodeReview(t *testing.T, rec *httptest.ResponseRecorder) *v1.AdmissionReview {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	review := &v1.AdmissionReview{}
+	if err := json.Unmarshal(rec.Body.Bytes(), review); err != nil {
+		t.Fatalf("invalid response %s: %v", rec.Body.String(), err)
+	}
+	if review.Response == nil {
+		t.Fatalf("response has no AdmissionResponse: %s", rec.Body.String())
+	}
+	return review
+}
+
+// Review the pod's creation and return the admission response
+func review(t *testing.T, pod *corev1.Pod) *v1.AdmissionResponse {
+	t.Helper()
+	return decodeReview(t, post(&WebhookServer{}, reviewBody(t, pod))).Response
+}
+
+// Number of samples in the patch size histogram
+func patchBytesSamples(t *testing.T) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := patchBytesHistogram.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestPatchBytesHistogram(t *testing.T) {
+	before := patchBytesSamples(t)
+	if response := review(t, testPod("broker-0", brokerDefinition, "broker")); len(response.Patch) == 0 {
+		t.Fatal("expected a patch")
+	}
+	if after := patchBytesSamples(t); after != before+1 {
+		t.Fatalf("expected one more histogram sample, got %d after %d", after, before)
+	}
+
+	rec := httptest.NewRecorder()
+	(&WebhookServer{}).handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "webhook_patch_bytes_count") {
+		t.Fatalf("expected /metrics to expose webhook_patch_bytes, got %s", rec.Body.String())
+	}
+}
+
+// Value of the mutations counter with the patched label
+func mutationsCount(t *testing.T, patched string) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := mutationsCounter.WithLabelValues(patched).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestMutationsCounter(t *testing.T) {
+	patched := mutationsCount(t, "true")
+	review(t, testPod("broker-0", brokerDefinition, "broker"))
+	if got := mutationsCount(t, "true"); got != patched+1 {
+		t.Fatalf("expected patched=true to count %v, got %v", patched+1, got)
+	}
+
+	// a pod matching the config entry but already converged, a pod the entry doesn't
+	// apply to and a pod in an ignored namespace are all reviewed without a patch
+	converged := testPod("broker-0", brokerDefinition, "broker")
+	converged.Spec.Containers[0].Image = "broker:2"
+	ignored := testPod("broker-0", brokerDefinition, "broker")
+	ignored.Namespace = metav1.NamespaceSystem
+	for name, pod := range map[string]*corev1.Pod{
+		"converged":  converged,
+		"unmatched":  testPod("broker-0", brokerDefinition, "monitor"),
+		"ignored ns": ignored,
+	} {
+		unpatched := mutationsCount(t, "false")
+		if response := review(t, pod); len(response.Patch) != 0 {
+			t.Fatalf("expected no patch for the %s pod, got %s", name, response.Patch)
+		}
+		if got := mutationsCount(t, "false"); got != unpatched+1 {
+			t.Errorf("expected patched=false to count the %s pod, got %v after %v", name, got, unpatched)
+		}
+	}
+}
+
+func TestWriteStatusAnnotation(t *testing.T) {
+	defer func(write bool) { writeStatusAnnotation = write }(writeStatusAnnotation)
+	pod := testPod("broker-0", brokerDefinition, "broker")
+	statusPath := "/metadata/annotations/" + strings.Replace(admissionWebhookAnnotationStatusKey, "/", "~1", -1)
+
+	writeStatusAnnotation = true
+	if response := review(t, pod); !strings.Contains(string(response.Patch), statusPath) {
+		t.Fatalf("expected the status annotation in the patch, got %s", response.Patch)
+	}
+
+	writeStatusAnnotation = false
+	response := review(t, pod)
+	if len(response.Patch) == 0 {
+		t.Fatal("expected a patch")
+	}
+	if strings.Contains(string(response.Patch), statusPath) {
+		t.Fatalf("expected no status annotation in the patch, got %s", response.Patch)
+	}
+}
+
+func TestServeContentType(t *testing.T) {
+	rec := post(&WebhookServer{}, reviewBody(t, testPod("broker-0", brokerDefinition, "broker")))
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Fatalf("expected Content-Type application/json, got %q", got)
+	}
+}
+
+func TestPrettyResponse(t *testing.T) {
+	defer func(pretty bool) { prettyResponse = pretty }(prettyResponse)
+	body := reviewBody(t, testPod("broker-0", brokerDefinition, "broker"))
+
+	prettyResponse = false
+	if compact := post(&WebhookServer{}, body).Body.String(); strings.Contains(compact, "\n  ") {
+		t.Fatalf("expected a compact response, got %s", compact)
+	}
+
+	prettyResponse = true
+	rec := post(&WebhookServer{}, body)
+	if !strings.Contains(rec.Body.String(), "\n  \"") {
+		t.Fatalf("expected an indented response, got %s", rec.Body.String())
+	}
+	if response := decodeReview(t, rec).Response; len(response.Patch) == 0 {
+		t.Fatal("expected the indented response to still carry the patch")
+	}
+}
+
+func TestServeMethodNotAllowed(t *testing.T) {
+	for _, method := range []string{http.MethodGet, http.MethodPut} {
+		rec := httptest.NewRecorder()
+		(&WebhookServer{}).serve(rec, httptest.NewRequest(method, "/mutate", nil))
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s: expected status 405, got %d", method, rec.Code)
+		}
+		if rec.Header().Get("Allow") != "POST, HEAD" {
+			t.Errorf("%s: expected Allow POST, HEAD, got %q", method, rec.Header().Get("Allow"))
+		}
+	}
+}
+
+func TestServeHeadProbe(t *testing.T) {
+	rec := httptest.NewRecorder()
+	(&WebhookServer{}).handler().ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/mutate", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200 for a HEAD probe, got %d", rec.Code)
+	}
+}
+
+// Post to /reload from the remote address
+func reloadFrom(remoteAddr string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/reload", nil)
+	req.RemoteAddr = remoteAddr
+	rec := httptest.NewRecorder()
+	(&WebhookServer{}).handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestReload(t *testing.T) {
+	defer func(path string) { configFile = path }(configFile)
+	defer fileConfig.Store(nil)
+	configFile = writeConfigFile(t, brokerConfig)
+	if _, err := loadConfigFile(configFile); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	pod := testPod("broker-0", "", "broker")
+	if response := review(t, pod); !strings.Contains(string(response.Patch), "broker:2") {
+		t.Fatalf("expected the loaded config's image, got %s", response.Patch)
+	}
+
+	if err := ioutil.WriteFile(configFile, []byte(strings.Replace(brokerConfig, "broker:2", "broker:3", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if rec := reloadFrom("10.0.0.1:40000"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected a reload from another host to be forbidden, got %d", rec.Code)
+	}
+	rec := reloadFrom("127.0.0.1:40000")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"reloaded"`) {
+		t.Fatalf("expected the reload to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if response := review(t, pod); !strings.Contains(string(response.Patch), "broker:3") {
+		t.Fatalf("expected the reloaded config's image, got %s", response.Patch)
+	}
+}
+
+func TestReloadInvalidKeepsConfig(t *testing.T) {
+	defer func(path string) { configFile = path }(configFile)
+	defer fileConfig.Store(nil)
+	configFile = writeConfigFile(t, brokerConfig)
+	if _, err := loadConfigFile(configFile); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pod := testPod("broker-0", "", "broker")
+
+	for name, content := range map[string]string{
+		"unparsable": "Pods: [",
+		"invalid":    brokerConfig + "- metadata:\n    name: broker-0\n",
+	} {
+		if err := ioutil.WriteFile(configFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if rec := reloadFrom("127.0.0.1:40000"); rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected the reload to fail, got %d: %s", name, rec.Code, rec.Body.String())
+		}
+		response := review(t, pod)
+		if !response.Allowed || !strings.Contains(string(response.Patch), "broker:2") {
+			t.Fatalf("%s: expected the previous config to still apply, got %s", name, response.Patch)
+		}
+	}
+}
+
+func TestRequestBodyLogLevel(t *testing.T) {
+	body := reviewBody(t, testPod("broker-0", brokerDefinition, "broker"))
+	for level, logged := range map[string]bool{"4": false, "6": true} {
+		var logs string
+		atLogLevel(level, func() {
+			logs = captureLogs(t, func() { post(&WebhookServer{}, body) })
+		})
+		if got := strings.Contains(logs, "Request body:"); got != logged {
+			t.Errorf("expected the request body logged=%v at level %s, got logs:\n%s", logged, level, logs)
+		}
+	}
+}
+
+func TestReviewDeniesUnknownDefinitionField(t *testing.T) {
+	definition := `{"Pods":[{"metadata":{"name":"broker-0"},"spec":{"containers":[{"name":"broker","imag":"broker:2"}]}}]}`
+	response := review(t, testPod("broker-0", definition, "broker"))
+	if response.Allowed || !strings.Contains(response.Result.Message, `unknown field "imag"`) {
+		t.Fatalf("expected a denial naming the unknown field, got %v", response.Result)
+	}
+}
+
+func TestSkipAnnotation(t *testing.T) {
+	pod := testPod("broker-0", brokerDefinition, "broker")
+	if response := review(t, pod); len(response.Patch) == 0 {
+		t.Fatal("expected a patch without the skip annotation")
+	}
+
+	pod.Annotations[annotation+".skip"] = "true"
+	response := review(t, pod)
+	if !response.Allowed || len(response.Patch) != 0 {
+		t.Fatalf("expected the pod to be admitted unchanged, got %s", response.Patch)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	defer func(lookup func(context.Context) (*mutation.Config, bool)) { lookupConfig = lookup }(lookupConfig)
+	// a lookup that only returns once its context ends, as a hanging API server call would
+	lookupErr := make(chan error, 1)
+	lookupConfig = func(ctx context.Context) (*mutation.Config, bool) {
+		select {
+		case <-ctx.Done():
+			lookupErr <- ctx.Err()
+		case <-time.After(5 * time.Second):
+			lookupErr <- nil
+		}
+		return nil, false
+	}
+
+	whsvr := &WebhookServer{requestTimeout: 50 * time.Millisecond}
+	response := decodeReview(t, post(whsvr, reviewBody(t, testPod("broker-0", "", "broker")))).Response
+	if err := <-lookupErr; err != context.DeadlineExceeded {
+		t.Fatalf("expected the lookup to be canceled by the request deadline, got %v", err)
+	}
+	if response.Allowed || !strings.Contains(response.Result.Message, context.DeadlineExceeded.Error()) {
+		t.Fatalf("expected a denial for the expired request, got %v", response.Result)
+	}
+}
+
+func TestAuditAnnotations(t *testing.T) {
+	response := review(t, testPod("broker-0", brokerDefinition, "broker"))
+	want := map[string]string{"matched": "true", "patched-paths": "/spec/containers/0/image"}
+	if !reflect.DeepEqual(response.AuditAnnotations, want) {
+		t.Fatalf("expected audit annotations %v, got %v", want, response.AuditAnnotations)
+	}
+
+	if response := review(t, testPod("other-0", brokerDefinition, "broker")); response.AuditAnnotations != nil {
+		t.Fatalf("expected no audit annotations without a patch, got %v", response.AuditAnnotations)
+	}
+}
+
+func TestEmitEvents(t *testing.T) {
+	recorder := record.NewFakeRecorder(1)
+	whsvr := &WebhookServer{recorder: recorder}
+	decodeReview(t, post(whsvr, reviewBody(t, testPod("broker-0", brokerDefinition, "broker"))))
+
+	select {
+	case event := <-recorder.Events:
+		want := "Normal PodModified Pod modified by " + eventComponent + ": /spec/containers/0/image"
+		if event != want {
+			t.Fatalf("expected event %q, got %q", want, event)
+		}
+	default:
+		t.Fatal("expected an event for the mutated pod")
+	}
+
+	decodeReview(t, post(whsvr, reviewBody(t, testPod("other-0", brokerDefinition, "broker"))))
+	select {
+	case event := <-recorder.Events:
+		t.Fatalf("expected no event without a patch, got %q", event)
+	default:
+	}
+}
+
+func TestIgnoredNamespacePattern(t *testing.T) {
+	matchers, err := namespaceMatchers([]string{"kube-system", "/istio-.*/"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mutationRequired(requestLogger{}, matchers, &metav1.ObjectMeta{Name: "broker-0", Namespace: "istio-system"}) {
+		t.Error("expected istio-system to be ignored")
+	}
+	if !mutationRequired(requestLogger{}, matchers, &metav1.ObjectMeta{Name: "broker-0", Namespace: "default"}) {
+		t.Error("expected default not to be ignored")
+	}
+
+	if _, err := namespaceMatchers([]string{"/istio-(/"}); err == nil {
+		t.Fatal("expected an error for an invalid regular expression")
+	}
+}
+
+func TestVerboseResult(t *testing.T) {
+	defer func(verbose bool) { verboseResult = verbose }(verboseResult)
+	pod := testPod("broker-0", brokerDefinition, "broker")
+
+	verboseResult = false
+	if response := review(t, pod); response.Result != nil {
+		t.Fatalf("expected no result by default, got %+v", response.Result)
+	}
+
+	verboseResult = true
+	response := review(t, pod)
+	if response.Result == nil || response.Result.Status != metav1.StatusSuccess || !strings.Contains(response.Result.Message, "default/broker-0 modified") {
+		t.Fatalf("expected a success result naming the pod, got %+v", response.Result)
+	}
+}
+
+// Set the pod's controller owner reference
+func ownedBy(pod *corev1.Pod, kind string) *corev1.Pod {
+	controller := true
+	pod.OwnerReferences = []metav1.OwnerReference{{APIVersion: "v1", Kind: kind, Name: "owner", UID: "1", Controller: &controller}}
+	return pod
+}
+
+func TestStatefulSetOnly(t *testing.T) {
+	defer func(only bool) { statefulSetOnly = only }(statefulSetOnly)
+	statefulSetOnly = true
+
+	if response := review(t, ownedBy(testPod("broker-0", brokerDefinition, "broker"), "Job")); len(response.Patch) != 0 {
+		t.Fatalf("expected a Job-owned pod to be skipped, got %s", response.Patch)
+	}
+	if response := review(t, ownedBy(testPod("broker-0", brokerDefinition, "broker"), "StatefulSet")); len(response.Patch) == 0 {
+		t.Fatal("expected a StatefulSet-owned pod to be patched")
+	}
+}
+
+func TestStatefulSetOnlyOwnerlessPod(t *testing.T) {
+	defer func(only bool) { statefulSetOnly = only }(statefulSetOnly)
+	statefulSetOnly = true
+
+	// as created by kubectl run, without an owner
+	response := review(t, testPod("broker-0", brokerDefinition, "broker"))
+	if !strings.Contains(string(response.Patch), `"broker:2"`) {
+		t.Fatalf("expected the ownerless pod named by the config to be patched, got %s", response.Patch)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	defer func(on bool, file string) { enabled, disableFile = on, file }(enabled, disableFile)
+	pod := testPod("broker-0", brokerDefinition, "broker")
+
+	enabled = false
+	if response := review(t, pod); !response.Allowed || len(response.Patch) != 0 {
+		t.Fatalf("expected the pod admitted unchanged with -enabled=false, got %s", response.Patch)
+	}
+
+	enabled = true
+	disableFile = filepath.Join(t.TempDir(), "disabled")
+	if response := review(t, pod); len(response.Patch) == 0 {
+		t.Fatal("expected a patch while the disable file is missing")
+	}
+	if err := ioutil.WriteFile(disableFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if response := review(t, pod); !response.Allowed || len(response.Patch) != 0 {
+		t.Fatalf("expected the pod admitted unchanged while the disable file exists, got %s", response.Patch)
+	}
+}
+
+func TestNumberedPodDefinitions(t *testing.T) {
+	pod := testPod("broker-1", "", "broker")
+	pod.Annotations = map[string]string{
+		annotation + ".podDefinition.0": brokerDefinition,
+		annotation + ".podDefinition.1": `{"Pods":[{"metadata":{"name":"broker-1"},"spec":{"containers":[{"name":"broker","image":"broker:3"}]}}]}`,
+	}
+	if response := review(t, pod); !strings.Contains(string(response.Patch), `"broker:3"`) {
+		t.Fatalf("expected the broker-1 entry of the second annotation to apply, got %s", response.Patch)
+	}
+}
+
+func TestNoChangesHasNoPatchFields(t *testing.T) {
+	definition := `{"Pods":[{"metadata":{"name":"broker-0"},"spec":{"containers":[{"name":"broker","image":"broker:1"}]}}]}`
+	rec := post(&WebhookServer{}, reviewBody(t, testPod("broker-0", definition, "broker")))
+
+	response := decodeReview(t, rec).Response
+	if !response.Allowed || response.Patch != nil || response.PatchType != nil {
+		t.Fatalf("expected an allowed response without patch fields, got %v", response)
+	}
+	if strings.Contains(rec.Body.String(), `"patch"`) || strings.Contains(rec.Body.String(), `"patchType"`) {
+		t.Fatalf("expected no patch fields in the response, got %s", rec.Body.String())
+	}
+}
+
+func TestParseFailureLoggedOnce(t *testing.T) {
+	pod := testPod("broker-0", `{"Pods":[{"metadata":{"name":"broker-0"}}`, "broker")
+	for i, logged := range []bool{true, false} {
+		var response *v1.AdmissionResponse
+		logs := captureLogs(t, func() { response = review(t, pod) })
+		if response.Allowed {
+			t.Fatalf("review %d: expected the pod to be denied", i+1)
+		}
+		if got := strings.Contains(logs, "Unmarshal failed err"); got != logged {
+			t.Errorf("review %d: expected the parse error logged=%v, got logs:\n%s", i+1, logged, logs)
+		}
+	}
+}
+
+func TestDeniedResponsesCarryNoPatch(t *testing.T) {
+	defer func(max int) { maxPatchOps = max }(maxPatchOps)
+	maxPatchOps = 1
+
+	// a pod patched at two paths, over the limit
+	pod := testPod("broker-0", `{"Pods":[{"metadata":{"name":"broker-0"},"spec":{"containers":[{"name":"broker","image":"broker:2","imagePullPolicy":"Always"}]}}]}`, "broker")
+	for name, response := range map[string]*v1.AdmissionResponse{
+		"invalid definition": review(t, testPod("broker-0", `{"Pods":[{"metadata":{"name":"broker-0"},"spec":{"unknown":true}}]}`, "broker")),
+		"too many ops":       review(t, pod),
+		"expired":            decodeReview(t, post(&WebhookServer{requestTimeout: time.Nanosecond}, reviewBody(t, testPod("broker-0", brokerDefinition, "broker")))).Response,
+	} {
+		if response.Allowed {
+			t.Errorf("%s: expected the pod to be denied", name)
+		}
+		if response.Patch != nil || response.PatchType != nil {
+			t.Errorf("%s: expected no patch on a denied response, got %s", name, response.Patch)
+		}
+	}
+}
+
+func TestWarnLevel(t *testing.T) {
+	defer func(level string) { warnLevel = level }(warnLevel)
+	// a pod no definition entry names is a notice, not a warning
+	pod := testPod("other-0", brokerDefinition, "broker")
+
+	warnLevel = warnLevelWarning
+	if response := review(t, pod); len(response.Warnings) != 0 {
+		t.Fatalf("expected no warnings at the default level, got %v", response.Warnings)
+	}
+
+	warnLevel = warnLevelInfo
+	response := review(t, pod)
+	if len(response.Warnings) != 1 || !strings.Contains(response.Warnings[0], "Pod name is not matching") {
+		t.Fatalf("expected the notice as a warning with -warnLevel=info, got %v", response.Warnings)
+	}
+}
+
+func TestValidationCauses(t *testing.T) {
+	definition := `{"Pods":[{"metadata":{"name":"broker-0"}},{"metadata":{"name":"broker-0"}}]}`
+	response := review(t, testPod("broker-0", definition, "broker"))
+	if response.Allowed || response.Result.Reason != metav1.StatusReasonInvalid || response.Result.Details == nil {
+		t.Fatalf("expected an invalid status with details, got %+v", response.Result)
+	}
+	causes := response.Result.Details.Causes
+	if len(causes) != 1 || causes[0].Type != metav1.CauseTypeFieldValueDuplicate || causes[0].Field != "Pods[1].metadata.name" {
+		t.Fatalf("expected a duplicate name cause for Pods[1], got %+v", causes)
+	}
+}
+
+func TestMaxPatchOps(t *testing.T) {
+	defer func(max int, warnOnly bool) { maxPatchOps, maxPatchOpsWarnOnly = max, warnOnly }(maxPatchOps, maxPatchOpsWarnOnly)
+	// two operations: the image and the pull policy
+	definition := `{"Pods":[{"metadata":{"name":"broker-0"},"spec":{"containers":[{"name":"broker","image":"broker:2","imagePullPolicy":"Always"}]}}]}`
+	pod := testPod("broker-0", definition, "broker")
+
+	maxPatchOps = 2
+	if response := review(t, pod); !response.Allowed || len(response.Patch) == 0 {
+		t.Fatal("expected a patch within the limit to be allowed")
+	}
+
+	maxPatchOps = 1
+	response := review(t, pod)
+	if response.Allowed || !strings.Contains(response.Result.Message, "2 operations, more than the allowed 1") {
+		t.Fatalf("expected the pod to be denied, got %+v", response.Result)
+	}
+
+	maxPatchOpsWarnOnly = true
+	response = review(t, pod)
+	if !response.Allowed || len(response.Patch) == 0 {
+		t.Fatal("expected the patch to be allowed with -maxPatchOpsWarnOnly")
+	}
+	if len(response.Warnings) != 1 || !strings.Contains(response.Warnings[0], "has 2 operations") {
+		t.Fatalf("expected a warning about the operations, got %v", response.Warnings)
+	}
+}
+
+func TestEncodeReviewFailure(t *testing.T) {
+	review := &v1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Response: &v1.AdmissionResponse{UID: testUID, Allowed: true},
+	}
+	// fails for the review, as an unencodable field would
+	marshal := func(v interface{}) ([]byte, error) {
+		if v == review {
+			return nil, &json.UnsupportedValueError{Str: "NaN"}
+		}
+		return json.Marshal(v)
+	}
+
+	resp, err := encodeReview(review, marshal)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var failure v1.AdmissionReview
+	if err := json.Unmarshal(resp, &failure); err != nil {
+		t.Fatal(err)
+	}
+	if failure.Kind != "AdmissionReview" || failure.Response == nil || failure.Response.UID != testUID || failure.Response.Allowed {
+		t.Fatalf("expected a failure review with the request UID, got %s", resp)
+	}
+	if !strings.Contains(failure.Response.Result.Message, "could not encode response") {
+		t.Fatalf("expected the encoding error in the result, got %+v", failure.Response.Result)
+	}
+}
+
+func TestEchoPod(t *testing.T) {
+	defer func(echo bool) { echoPod = echo }(echoPod)
+	echoPod = true
+
+	response := review(t, testPod("broker-0", brokerDefinition, "broker", "monitor"))
+	if !response.Allowed || response.Patch != nil {
+		t.Fatalf("expected the pod admitted without a patch, got %s", response.Patch)
+	}
+	want := []string{"echo: decoded pod default/broker-0 with containers [broker, monitor]"}
+	if !reflect.DeepEqual(response.Warnings, want) {
+		t.Fatalf("expected warnings %v, got %v", want, response.Warnings)
+	}
+}
+
+func TestReviewWithoutRequest(t *testing.T) {
+	body := []byte(`{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview"}`)
+	response := decodeReview(t, post(&WebhookServer{}, body)).Response
+	if response.Allowed || response.Result == nil || response.Result.Status != metav1.StatusFailure {
+		t.Fatalf("expected a failure response, got %v", response)
+	}
+}
+
+func TestServeOverTLS(t *testing.T) {
+	server := httptest.NewTLSServer((&WebhookServer{}).handler())
+	defer server.Close()
+
+	body := reviewBody(t, testPod("broker-0", brokerDefinition, "broker"))
+	resp, err := server.Client().Post(server.URL+"/mutate", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %s", resp.Status)
+	}
+
+	var review v1.AdmissionReview
+	if err := json.NewDecoder(resp.Body).Decode(&review); err != nil {
+		t.Fatal(err)
+	}
+	if review.APIVersion != "admission.k8s.io/v1" || review.Kind != "AdmissionReview" {
+		t.Errorf("expected an admission.k8s.io/v1 AdmissionReview, got %s %s", review.APIVersion, review.Kind)
+	}
+	if review.Response == nil {
+		t.Fatal("expected a response")
+	}
+	if review.Response.UID != testUID {
+		t.Errorf("expected UID %s, got %s", testUID, review.Response.UID)
+	}
+	if want := `[{"op":"replace","path":"/spec/containers/0/image","value":"broker:2"}]`; string(review.Response.Patch) != want {
+		t.Errorf("expected patch %s, got %s", want, review.Response.Patch)
+	}
+	if review.Response.PatchType == nil || *review.Response.PatchType != v1.PatchTypeJSONPatch {
+		t.Errorf("expected patch type JSONPatch, got %v", review.Response.PatchType)
+	}
+}
+
+func TestStatusAnnotationKey(t *testing.T) {
+	defer func(write bool) { writeStatusAnnotation = write }(writeStatusAnnotation)
+	defer func(key string) { admissionWebhookAnnotationStatusKey = key }(admissionWebhookAnnotationStatusKey)
+	writeStatusAnnotation = true
+	admissionWebhookAnnotationStatusKey = "example.com/status"
+
+	response := review(t, testPod("broker-0", brokerDefinition, "broker"))
+	if !strings.Contains(string(response.Patch), `"path":"/metadata/annotations/example.com~1status"`) {
+		t.Fatalf("expected the configured status annotation key in the patch, got %s", response.Patch)
+	}
+}
+
+func TestStrictContainerMatch(t *testing.T) {
+	defer func(strict bool) { strictContainerMatch = strict }(strictContainerMatch)
+	definition := `{"Pods":[{"metadata":{"name":"broker-0"},"spec":{"containers":[{"name":"brokr","image":"broker:2"}]}}]}`
+	pod := testPod("broker-0", definition, "broker")
+
+	strictContainerMatch = false
+	response := review(t, pod)
+	if !response.Allowed || len(response.Warnings) != 1 || !strings.Contains(response.Warnings[0], `"brokr"`) {
+		t.Fatalf("expected the pod to be admitted with a warning naming brokr, got %v", response)
+	}
+
+	strictContainerMatch = true
+	response = review(t, pod)
+	if response.Allowed || !strings.Contains(response.Result.Message, `"brokr"`) {
+		t.Fatalf("expected a denial naming brokr, got %v", response)
+	}
+}
+
+func TestRequestLogsCarryUID(t *testing.T) {
+	logs := captureLogs(t, func() { review(t, testPod("broker-0", brokerDefinition, "broker")) })
+
+	// the lines logged while admitting the pod, serve's own lines come before and after
+	markers := []string{"AdmissionReview for", "Create patch for pod", "AdmissionResponse:"}
+	found := 0
+	for _, line := range strings.Split(logs, "\n") {
+		for _, marker := range markers {
+			if strings.Contains(line, marker) {
+				found++
+				if !strings.Contains(line, "] ["+testUID+"] "+marker) {
+					t.Errorf("expected the request UID before %q, got %s", marker, line)
+				}
+			}
+		}
+	}
+	if found != len(markers) {
+		t.Fatalf("expected %d request lines, found %d in logs:\n%s", len(markers), found, logs)
+	}
+}
+
+func TestMaxConfigPods(t *testing.T) {
+	defer func(max int) { maxConfigPods = max }(maxConfigPods)
+	maxConfigPods = 1
+	definition := `{"Pods":[{"metadata":{"name":"broker-0"}},{"metadata":{"name":"broker-1"}}]}`
+
+	response := review(t, testPod("broker-0", definition, "broker"))
+	if response.Allowed || !strings.Contains(response.Result.Message, "more than 1 pods") {
+		t.Fatalf("expected a denial for too many config pods, got %v", response.Result)
+	}
+
+	maxConfigPods = 2
+	if response := review(t, testPod("broker-0", definition, "broker")); !response.Allowed {
+		t.Fatalf("expected the pod to be admitted within the limit, got %v", response.Result)
+	}
+}
+
+func TestServeChunkedBody(t *testing.T) {
+	var transferEncoding []string
+	handler := (&WebhookServer{}).handler()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		transferEncoding = r.TransferEncoding
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	body := reviewBody(t, testPod("broker-0", brokerDefinition, "broker"))
+
+	// a reader of unknown length makes the client send the body chunked
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/mutate", io.MultiReader(bytes.NewReader(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if !reflect.DeepEqual(transferEncoding, []string{"chunked"}) {
+		t.Fatalf("expected a chunked request, got transfer encoding %v", transferEncoding)
+	}
+
+	var review v1.AdmissionReview
+	if err := json.NewDecoder(resp.Body).Decode(&review); err != nil {
+		t.Fatal(err)
+	}
+	if review.Response == nil || !strings.Contains(string(review.Response.Patch), "broker:2") {
+		t.Fatalf("expected the chunked review to be patched, got %v", review.Response)
+	}
+}
+
+func TestServeBodyTooLarge(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/mutate", io.MultiReader(bytes.NewReader(make([]byte, maxRequestBodyBytes+1))))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	(&WebhookServer{}).handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status 413 for a body over the cap, got %d", rec.Code)
+	}
+}
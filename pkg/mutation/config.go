@@ -0,0 +1,304 @@
+package mutation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// replace the container resources with the configured ones
+	ResourcesPolicyReplace = ""
+	// only apply configured quantities higher than the container's current ones
+	ResourcesPolicyOnlyIfLessThan = "onlyIfLessThan"
+	// only set resources on containers that have neither limits nor requests
+	ResourcesPolicyOnlyIfUnset = "onlyIfUnset"
+)
+
+const (
+	// replace the container security context with the configured one
+	SecurityContextPolicyReplace = ""
+	// only override the security context fields the config sets
+	SecurityContextPolicyMerge = "merge"
+)
+
+// Config holds the pod definitions applied to the pods they name
+type Config struct {
+	Pods []ConfigPod `json:"Pods"`
+
+	// named resources that config pods can refer to by their profile
+	Profiles map[string]corev1.ResourceRequirements `json:"profiles,omitempty"`
+
+	// compiled container name matchers by name, set once Validate accepts the config
+	matchers map[string]func(string) bool
+}
+
+// Return the matcher for a config container name, compiling names the config didn't
+// hold when it was validated, e.g. names with expanded templates
+func (c *Config) matcher(name string) (func(string) bool, error) {
+	if matches, ok := c.matchers[name]; ok {
+		return matches, nil
+	}
+	return NameMatcher(name)
+}
+
+// ConfigPod is a pod definition in the config along with settings that have no place in the pod spec
+type ConfigPod struct {
+	corev1.Pod `json:",inline"`
+
+	// name or UID of the owner, e.g. the StatefulSet, the pod must have for the entry to match
+	Owner string `json:"owner,omitempty"`
+
+	// image set on every container and init container of the matched pod, unless the config
+	// container sets its own
+	ImageOverride string `json:"imageOverride,omitempty"`
+
+	// pull policy set on every container of the matched pod, unless the config container sets its own
+	ImagePullPolicy corev1.PullPolicy `json:"imagePullPolicy,omitempty"`
+
+	// name of the resource profile used by config containers that don't set resources
+	Profile string `json:"profile,omitempty"`
+
+	// profiles by ordinal range, the first range holding the pod's ordinal overrides profile
+	OrdinalProfiles []OrdinalProfile `json:"ordinalProfiles,omitempty"`
+
+	// how container resources are applied, one of the ResourcesPolicy constants
+	ResourcesPolicy string `json:"resourcesPolicy,omitempty"`
+
+	// how container security contexts are applied, one of the SecurityContextPolicy constants
+	SecurityContextPolicy string `json:"securityContextPolicy,omitempty"`
+
+	// percentage of matching pods, chosen by a hash of the pod name, the entry is applied to; all if unset
+	CanaryPercent *int `json:"canaryPercent,omitempty"`
+
+	// names of containers moved, in this order, to the front of the pod's containers
+	ContainerOrder []string `json:"containerOrder,omitempty"`
+
+	// env vars computed from the containers' resources once the config is applied
+	DerivedEnv []DerivedEnv `json:"derivedEnv,omitempty"`
+
+	// label and annotation keys removed from the pod
+	RemoveLabels      []string `json:"removeLabels,omitempty"`
+	RemoveAnnotations []string `json:"removeAnnotations,omitempty"`
+
+	// config containers targeting pod containers by position, for pods whose names are ambiguous
+	ContainersByIndex     []IndexedContainer `json:"containersByIndex,omitempty"`
+	InitContainersByIndex []IndexedContainer `json:"initContainersByIndex,omitempty"`
+
+	// init containers added to the pod at the given positions
+	InsertInitContainers []InitContainerInsert `json:"insertInitContainers,omitempty"`
+
+	// host namespace settings, taking precedence over the pod spec's, which can't tell an
+	// explicit false from an unset field
+	HostNetwork *bool `json:"hostNetwork,omitempty"`
+	HostPID     *bool `json:"hostPID,omitempty"`
+	HostIPC     *bool `json:"hostIPC,omitempty"`
+}
+
+// InitContainerInsert is an init container to insert at a position in the pod's init containers
+type InitContainerInsert struct {
+	Index     int              `json:"index"`
+	Container corev1.Container `json:"container"`
+}
+
+// IndexedContainer is a config container applied to the pod's container at the index, whatever its name
+type IndexedContainer struct {
+	Index     int              `json:"index"`
+	Container corev1.Container `json:"container"`
+}
+
+// OrdinalProfile is a resource profile used by pods whose StatefulSet ordinal is in the range
+type OrdinalProfile struct {
+	From int `json:"from"`
+
+	// last ordinal of the range, inclusive; no upper bound if unset
+	To *int `json:"to,omitempty"`
+
+	Profile string `json:"profile"`
+}
+
+// DerivedEnv is an env var set from a container's resources, e.g. GOMAXPROCS from the CPU limit
+type DerivedEnv struct {
+	Name string `json:"name"`
+
+	// container name or /regex/ the var is set on; all containers if empty
+	Container string `json:"container,omitempty"`
+
+	// resource the value is taken from, in downward API form, e.g. limits.cpu or requests.memory
+	Resource string `json:"resource"`
+
+	// unit of the value, which is rounded up; 1 if unset
+	Divisor resource.Quantity `json:"divisor,omitempty"`
+
+	// fmt format of the value, e.g. -Xmx%dm; %d if unset
+	Format string `json:"format,omitempty"`
+}
+
+// ValidationError lists every invalid field of a config
+type ValidationError struct {
+	Causes []metav1.StatusCause
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Causes))
+	for _, cause := range e.Causes {
+		msgs = append(msgs, cause.Field+": "+cause.Message)
+	}
+	return "invalid config: " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) add(causeType metav1.CauseType, field string, format string, args ...interface{}) {
+	e.Causes = append(e.Causes, metav1.StatusCause{
+		Type:    causeType,
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Validate checks the config for entries that can't be matched unambiguously or applied.
+// It returns a *ValidationError listing all problems found. A valid config keeps its
+// compiled container name matchers, so it must not be modified afterwards.
+func (c *Config) Validate() error {
+	verr := &ValidationError{}
+	matchers := map[string]func(string) bool{}
+	compile := func(name string) error {
+		if _, ok := matchers[name]; ok {
+			return nil
+		}
+		matches, err := NameMatcher(name)
+		if err != nil {
+			return err
+		}
+		matchers[name] = matches
+		return nil
+	}
+	seen := make(map[string]int, len(c.Pods))
+	for i, cpod := range c.Pods {
+		field := fmt.Sprintf("Pods[%d]", i)
+
+		key := cpod.ObjectMeta.Namespace + "/" + cpod.ObjectMeta.Name
+		if cpod.ObjectMeta.Name == "" {
+			key += cpod.ObjectMeta.GenerateName + "*"
+		}
+		if cpod.Owner != "" {
+			key += " owned by " + cpod.Owner
+		}
+		if prev, ok := seen[key]; ok {
+			verr.add(metav1.CauseTypeFieldValueDuplicate, field+".metadata.name", "config pods %d and %d have the same name %q", prev, i, key)
+		} else {
+			seen[key] = i
+		}
+
+		if _, ok := c.Profiles[cpod.Profile]; cpod.Profile != "" && !ok {
+			verr.add(metav1.CauseTypeFieldValueNotFound, field+".profile", "unknown profile %q", cpod.Profile)
+		}
+
+		for j, rule := range cpod.OrdinalProfiles {
+			ruleField := fmt.Sprintf("%s.ordinalProfiles[%d]", field, j)
+			if rule.From < 0 {
+				verr.add(metav1.CauseTypeFieldValueInvalid, ruleField+".from", "from %d is negative", rule.From)
+			}
+			if rule.To != nil && *rule.To < rule.From {
+				verr.add(metav1.CauseTypeFieldValueInvalid, ruleField+".to", "to %d is less than from %d", *rule.To, rule.From)
+			}
+			if _, ok := c.Profiles[rule.Profile]; !ok {
+				verr.add(metav1.CauseTypeFieldValueNotFound, ruleField+".profile", "unknown profile %q", rule.Profile)
+			}
+		}
+
+		if cpod.CanaryPercent != nil && (*cpod.CanaryPercent < 0 || *cpod.CanaryPercent > 100) {
+			verr.add(metav1.CauseTypeFieldValueInvalid, field+".canaryPercent", "canaryPercent %d is not between 0 and 100", *cpod.CanaryPercent)
+		}
+
+		switch cpod.ResourcesPolicy {
+		case ResourcesPolicyReplace, ResourcesPolicyOnlyIfLessThan, ResourcesPolicyOnlyIfUnset:
+		default:
+			verr.add(metav1.CauseTypeFieldValueNotSupported, field+".resourcesPolicy", "unknown resourcesPolicy %q", cpod.ResourcesPolicy)
+		}
+
+		for j, rule := range cpod.DerivedEnv {
+			ruleField := fmt.Sprintf("%s.derivedEnv[%d]", field, j)
+			if rule.Name == "" {
+				verr.add(metav1.CauseTypeFieldValueRequired, ruleField+".name", "derived env var has no name")
+			}
+			if source, name, _ := strings.Cut(rule.Resource, "."); (source != "limits" && source != "requests") || name == "" {
+				verr.add(metav1.CauseTypeFieldValueInvalid, ruleField+".resource", "resource %q is not of the form limits.<name> or requests.<name>", rule.Resource)
+			}
+			if rule.Divisor.Sign() < 0 {
+				verr.add(metav1.CauseTypeFieldValueInvalid, ruleField+".divisor", "divisor %s is negative", rule.Divisor.String())
+			}
+			if rule.Container != "" {
+				if err := compile(rule.Container); err != nil {
+					verr.add(metav1.CauseTypeFieldValueInvalid, ruleField+".container", "%v", err)
+				}
+			}
+		}
+
+		switch cpod.SecurityContextPolicy {
+		case SecurityContextPolicyReplace, SecurityContextPolicyMerge:
+		default:
+			verr.add(metav1.CauseTypeFieldValueNotSupported, field+".securityContextPolicy", "unknown securityContextPolicy %q", cpod.SecurityContextPolicy)
+		}
+
+		for j, container := range cpod.Spec.Containers {
+			if err := compile(container.Name); err != nil {
+				verr.add(metav1.CauseTypeFieldValueInvalid, fmt.Sprintf("%s.spec.containers[%d].name", field, j), "%v", err)
+			}
+		}
+		for j, container := range cpod.Spec.InitContainers {
+			if err := compile(container.Name); err != nil {
+				verr.add(metav1.CauseTypeFieldValueInvalid, fmt.Sprintf("%s.spec.initContainers[%d].name", field, j), "%v", err)
+			}
+		}
+	}
+	if len(verr.Causes) > 0 {
+		return verr
+	}
+	c.matchers = matchers
+	return nil
+}
+
+// ParsePodDefinition parses a podDefinition annotation. It holds either a config with a
+// Pods list or, when there is only one, the config pod by itself. Unknown fields are an
+// error, so a misspelled field isn't silently left out of the patch.
+func ParsePodDefinition(data []byte) (*Config, error) {
+	c := &Config{}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return c, err
+	}
+	for key := range fields {
+		if strings.EqualFold(key, "pods") || strings.EqualFold(key, "profiles") {
+			err := unmarshalStrict(data, c)
+			return c, err
+		}
+	}
+
+	var cpod ConfigPod
+	if err := unmarshalStrict(data, &cpod); err != nil {
+		return c, err
+	}
+	c.Pods = []ConfigPod{cpod}
+	return c, nil
+}
+
+// ParseConfig parses a config in YAML or JSON, e.g. a config file. As for ParsePodDefinition,
+// unknown fields are an error.
+func ParseConfig(data []byte) (*Config, error) {
+	c := &Config{}
+	err := yaml.UnmarshalStrict(data, c)
+	return c, err
+}
+
+// Unmarshal the JSON into v, failing on fields v has no place for
+func unmarshalStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
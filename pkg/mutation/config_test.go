@@ -0,0 +1,95 @@
+package mutation
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateDuplicateNames(t *testing.T) {
+	tests := []struct {
+		name       string
+		namespaces []string
+		owners     []string
+		duplicate  bool
+	}{
+		{name: "same name", namespaces: []string{"", ""}, owners: []string{"", ""}, duplicate: true},
+		{name: "same name and namespace", namespaces: []string{"dev", "dev"}, owners: []string{"", ""}, duplicate: true},
+		{name: "different namespaces", namespaces: []string{"dev", "prod"}, owners: []string{"", ""}},
+		{name: "name-only and namespaced", namespaces: []string{"", "dev"}, owners: []string{"", ""}},
+		{name: "different owners", namespaces: []string{"", ""}, owners: []string{"broker", "backup"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			for i := range tt.namespaces {
+				cpod := ConfigPod{Owner: tt.owners[i]}
+				cpod.Name = "broker-0"
+				cpod.Namespace = tt.namespaces[i]
+				cfg.Pods = append(cfg.Pods, cpod)
+			}
+
+			err := cfg.Validate()
+			if !tt.duplicate {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			verr, ok := err.(*ValidationError)
+			if !ok || len(verr.Causes) != 1 || verr.Causes[0].Type != metav1.CauseTypeFieldValueDuplicate || verr.Causes[0].Field != "Pods[1].metadata.name" {
+				t.Fatalf("expected a duplicate name cause for Pods[1], got %v", err)
+			}
+		})
+	}
+}
+
+func TestParsePodDefinitionUnknownField(t *testing.T) {
+	for _, definition := range []string{
+		`{"Pods":[{"metadata":{"name":"broker-0"},"spec":{"containers":[{"name":"broker","imag":"broker:2"}]}}]}`,
+		`{"metadata":{"name":"broker-0"},"spec":{"containers":[{"name":"broker","imag":"broker:2"}]}}`,
+		`{"metadata":{"name":"broker-0"},"resourcePolicy":"onlyIfUnset"}`,
+	} {
+		if _, err := ParsePodDefinition([]byte(definition)); err == nil || !strings.Contains(err.Error(), "unknown field") {
+			t.Errorf("expected an unknown field error for %s, got %v", definition, err)
+		}
+	}
+}
+
+func TestParsePodDefinitionSinglePod(t *testing.T) {
+	single := `{"metadata":{"name":"broker-0"},"spec":{"containers":[{"name":"broker","image":"broker:2"}]}}`
+	c, err := ParsePodDefinition([]byte(single))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(c.Pods) != 1 || c.Pods[0].Name != "broker-0" || c.Pods[0].Spec.Containers[0].Image != "broker:2" {
+		t.Fatalf("expected the single pod as the only config pod, got %+v", c.Pods)
+	}
+
+	wrapped, err := ParsePodDefinition([]byte(`{"Pods":[` + single + `]}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(wrapped, c) {
+		t.Fatalf("expected the wrapped definition to parse the same, got %+v", wrapped.Pods)
+	}
+}
+
+func TestParseConfigUnknownField(t *testing.T) {
+	config := `
+Pods:
+  - metadata:
+      name: broker-0
+    spec:
+      containers:
+        - name: broker
+          resource:
+            limits:
+              memory: 2Gi
+`
+	if _, err := ParseConfig([]byte(config)); err == nil || !strings.Contains(err.Error(), "unknown field") {
+		t.Fatalf("expected an unknown field error for the misspelled resources, got %v", err)
+	}
+}
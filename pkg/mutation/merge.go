@@ -0,0 +1,393 @@
+package mutation
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	inf "gopkg.in/inf.v0"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Merge config env vars into the container env. A var with the same name is replaced
+// in place, including its valueFrom source and whether the referenced secret or config
+// map key is optional, new vars are appended in config order. The pod's vars are never
+// reordered, as $(VAR) references only resolve to earlier vars.
+func mergeEnv(env []corev1.EnvVar, configEnv []corev1.EnvVar) []corev1.EnvVar {
+	for _, configVar := range configEnv {
+		replaced := false
+		for i := range env {
+			if env[i].Name == configVar.Name {
+				env[i] = *configVar.DeepCopy()
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			env = append(env, *configVar.DeepCopy())
+		}
+	}
+	return env
+}
+
+// Merge config volume devices into the container's, matching devices by volume name
+func mergeVolumeDevices(devices []corev1.VolumeDevice, configDevices []corev1.VolumeDevice) []corev1.VolumeDevice {
+	for _, configDevice := range configDevices {
+		replaced := false
+		for i := range devices {
+			if devices[i].Name == configDevice.Name {
+				devices[i] = configDevice
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			devices = append(devices, configDevice)
+		}
+	}
+	return devices
+}
+
+// Raise the quantities of the container resources to the configured ones. Quantities
+// already at or above the configured value are left alone. Every resource name is
+// merged, including extended resources such as nvidia.com/gpu.
+func raiseResources(resources corev1.ResourceRequirements, configResources corev1.ResourceRequirements) corev1.ResourceRequirements {
+	resources.Limits = raiseResourceList(resources.Limits, configResources.Limits)
+	resources.Requests = raiseResourceList(resources.Requests, configResources.Requests)
+	return resources
+}
+
+func raiseResourceList(list corev1.ResourceList, configList corev1.ResourceList) corev1.ResourceList {
+	for name, quantity := range configList {
+		if current, ok := list[name]; ok && current.Cmp(quantity) >= 0 {
+			continue
+		}
+		if list == nil {
+			list = corev1.ResourceList{}
+		}
+		list[name] = quantity.DeepCopy()
+	}
+	return list
+}
+
+// Scale the limits and requests of the config containers by the factor. The containers
+// are copied, the config they come from is left alone.
+func scaleResources(configContainers []corev1.Container, factor float64) ([]corev1.Container, error) {
+	scaled := make([]corev1.Container, len(configContainers))
+	for i := range configContainers {
+		scaled[i] = *configContainers[i].DeepCopy()
+		var err error
+		if scaled[i].Resources.Limits, err = scaleResourceList(scaled[i].Resources.Limits, factor); err != nil {
+			return nil, fmt.Errorf("container %s limits: %v", scaled[i].Name, err)
+		}
+		if scaled[i].Resources.Requests, err = scaleResourceList(scaled[i].Resources.Requests, factor); err != nil {
+			return nil, fmt.Errorf("container %s requests: %v", scaled[i].Name, err)
+		}
+	}
+	return scaled, nil
+}
+
+// Scale the resources of the config containers targeting pod containers by position
+func scaleIndexedResources(targets []IndexedContainer, factor float64) ([]IndexedContainer, error) {
+	scaled := make([]IndexedContainer, len(targets))
+	for i, target := range targets {
+		containers, err := scaleResources([]corev1.Container{target.Container}, factor)
+		if err != nil {
+			return nil, err
+		}
+		scaled[i] = IndexedContainer{Index: target.Index, Container: containers[0]}
+	}
+	return scaled, nil
+}
+
+func scaleResourceList(list corev1.ResourceList, factor float64) (corev1.ResourceList, error) {
+	if factor == 1 {
+		return list, nil
+	}
+	for name, quantity := range list {
+		scaled, err := scaleQuantity(name, quantity, factor)
+		if err != nil {
+			return nil, err
+		}
+		list[name] = scaled
+	}
+	return list, nil
+}
+
+// Scale a quantity by the factor. cpu keeps milli precision, the other resources, memory
+// and storage in bytes among them, are rounded to whole units.
+func scaleQuantity(name corev1.ResourceName, quantity resource.Quantity, factor float64) (resource.Quantity, error) {
+	f, ok := new(inf.Dec).SetString(strconv.FormatFloat(factor, 'f', -1, 64))
+	if !ok {
+		return resource.Quantity{}, fmt.Errorf("invalid resource multiplier %v", factor)
+	}
+	scale := inf.Scale(0)
+	if name == corev1.ResourceCPU {
+		scale = 3
+	}
+	scaled := new(inf.Dec).Round(new(inf.Dec).Mul(quantity.AsDec(), f), scale, inf.RoundHalfUp)
+	if !scaled.UnscaledBig().IsInt64() {
+		return resource.Quantity{}, fmt.Errorf("%s %s scaled by %v is out of range", name, quantity.String(), factor)
+	}
+	if scale == 3 {
+		return *resource.NewMilliQuantity(scaled.UnscaledBig().Int64(), quantity.Format), nil
+	}
+	return *resource.NewQuantity(scaled.UnscaledBig().Int64(), quantity.Format), nil
+}
+
+// Override the fields of the security context the config sets, keeping the others
+func mergeSecurityContext(securityContext *corev1.SecurityContext, configSecurityContext *corev1.SecurityContext) *corev1.SecurityContext {
+	merged := &corev1.SecurityContext{}
+	if securityContext != nil {
+		merged = securityContext.DeepCopy()
+	}
+	override := configSecurityContext.DeepCopy()
+	if override.Capabilities != nil {
+		merged.Capabilities = override.Capabilities
+	}
+	if override.Privileged != nil {
+		merged.Privileged = override.Privileged
+	}
+	if override.SELinuxOptions != nil {
+		merged.SELinuxOptions = override.SELinuxOptions
+	}
+	if override.WindowsOptions != nil {
+		merged.WindowsOptions = override.WindowsOptions
+	}
+	if override.RunAsUser != nil {
+		merged.RunAsUser = override.RunAsUser
+	}
+	if override.RunAsGroup != nil {
+		merged.RunAsGroup = override.RunAsGroup
+	}
+	if override.RunAsNonRoot != nil {
+		merged.RunAsNonRoot = override.RunAsNonRoot
+	}
+	if override.ReadOnlyRootFilesystem != nil {
+		merged.ReadOnlyRootFilesystem = override.ReadOnlyRootFilesystem
+	}
+	if override.AllowPrivilegeEscalation != nil {
+		merged.AllowPrivilegeEscalation = override.AllowPrivilegeEscalation
+	}
+	if override.ProcMount != nil {
+		merged.ProcMount = override.ProcMount
+	}
+	if override.SeccompProfile != nil {
+		merged.SeccompProfile = override.SeccompProfile
+	}
+	return merged
+}
+
+// Insert a container at the index, shifting the following ones. An index past the end
+// appends. Nothing is inserted if a container with the same name already exists.
+func insertContainer(containers []corev1.Container, index int, container corev1.Container) ([]corev1.Container, bool) {
+	for _, c := range containers {
+		if c.Name == container.Name {
+			return containers, false
+		}
+	}
+	if index < 0 {
+		index = 0
+	}
+	if index > len(containers) {
+		index = len(containers)
+	}
+
+	inserted := make([]corev1.Container, 0, len(containers)+1)
+	inserted = append(inserted, containers[:index]...)
+	inserted = append(inserted, *container.DeepCopy())
+	return append(inserted, containers[index:]...), true
+}
+
+// Append the config ephemeral containers the pod doesn't have yet, by name
+func appendEphemeralContainers(containers []corev1.EphemeralContainer, configContainers []corev1.EphemeralContainer) ([]corev1.EphemeralContainer, bool) {
+	appended := false
+	for _, configContainer := range configContainers {
+		exists := false
+		for _, c := range containers {
+			if c.Name == configContainer.Name {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			containers = append(containers, *configContainer.DeepCopy())
+			appended = true
+		}
+	}
+	return containers, appended
+}
+
+// Append the config tolerations the pod doesn't have yet. Tolerations are compared on
+// every field, so the same toleration with different tolerationSeconds is added.
+func mergeTolerations(tolerations []corev1.Toleration, configTolerations []corev1.Toleration) ([]corev1.Toleration, bool) {
+	appended := false
+	for _, configToleration := range configTolerations {
+		exists := false
+		for _, t := range tolerations {
+			if tolerationEqual(t, configToleration) {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			tolerations = append(tolerations, *configToleration.DeepCopy())
+			appended = true
+		}
+	}
+	return tolerations, appended
+}
+
+func tolerationEqual(a, b corev1.Toleration) bool {
+	if a.Key != b.Key || a.Operator != b.Operator || a.Value != b.Value || a.Effect != b.Effect {
+		return false
+	}
+	if a.TolerationSeconds == nil || b.TolerationSeconds == nil {
+		return a.TolerationSeconds == nil && b.TolerationSeconds == nil
+	}
+	return *a.TolerationSeconds == *b.TolerationSeconds
+}
+
+// Merge config sysctls into the pod's by name, replacing the value of a sysctl the pod
+// already sets
+func mergeSysctls(sysctls []corev1.Sysctl, configSysctls []corev1.Sysctl) []corev1.Sysctl {
+	for _, configSysctl := range configSysctls {
+		replaced := false
+		for i := range sysctls {
+			if sysctls[i].Name == configSysctl.Name {
+				sysctls[i].Value = configSysctl.Value
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			sysctls = append(sysctls, configSysctl)
+		}
+	}
+	return sysctls
+}
+
+// Merge the config DNS config into the pod's. Nameservers and searches the pod doesn't
+// have are appended, options are merged by name with the config value winning.
+func mergeDNSConfig(dnsConfig *corev1.PodDNSConfig, configDNSConfig *corev1.PodDNSConfig) *corev1.PodDNSConfig {
+	merged := &corev1.PodDNSConfig{}
+	if dnsConfig != nil {
+		merged = dnsConfig.DeepCopy()
+	}
+	merged.Nameservers = appendMissing(merged.Nameservers, configDNSConfig.Nameservers)
+	merged.Searches = appendMissing(merged.Searches, configDNSConfig.Searches)
+	for _, configOption := range configDNSConfig.Options {
+		replaced := false
+		for i := range merged.Options {
+			if merged.Options[i].Name == configOption.Name {
+				merged.Options[i] = *configOption.DeepCopy()
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged.Options = append(merged.Options, *configOption.DeepCopy())
+		}
+	}
+	return merged
+}
+
+func appendMissing(values []string, configValues []string) []string {
+	for _, configValue := range configValues {
+		exists := false
+		for _, v := range values {
+			if v == configValue {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			values = append(values, configValue)
+		}
+	}
+	return values
+}
+
+// Move the named containers to the front in the given order, the others keep their
+// relative order after them. Names not in the pod are ignored.
+func reorderContainers(containers []corev1.Container, order []string) ([]corev1.Container, bool) {
+	reordered := make([]corev1.Container, 0, len(containers))
+	moved := map[string]bool{}
+	for _, name := range order {
+		for _, c := range containers {
+			if c.Name == name && !moved[name] {
+				reordered = append(reordered, c)
+				moved[name] = true
+			}
+		}
+	}
+	for _, c := range containers {
+		if !moved[c.Name] {
+			reordered = append(reordered, c)
+		}
+	}
+
+	changed := false
+	for i := range containers {
+		if containers[i].Name != reordered[i].Name {
+			changed = true
+		}
+	}
+	return reordered, changed
+}
+
+// Set the derived env vars on the containers they apply to, from the containers' current
+// resources. Containers without the resource don't get the var.
+func applyDerivedEnv(cfg *Config, containers []corev1.Container, rules []DerivedEnv) bool {
+	changed := false
+	for _, rule := range rules {
+		matches := func(string) bool { return true }
+		if rule.Container != "" {
+			var err error
+			if matches, err = cfg.matcher(rule.Container); err != nil {
+				continue
+			}
+		}
+		for ii := range containers {
+			if !matches(containers[ii].Name) {
+				continue
+			}
+			value, ok := derivedValue(containers[ii].Resources, rule)
+			if !ok {
+				continue
+			}
+			containers[ii].Env = mergeEnv(containers[ii].Env, []corev1.EnvVar{{Name: rule.Name, Value: value}})
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Compute the derived env var value from the resources, false if the resource isn't set
+func derivedValue(resources corev1.ResourceRequirements, rule DerivedEnv) (string, bool) {
+	var list corev1.ResourceList
+	source, name, _ := strings.Cut(rule.Resource, ".")
+	switch source {
+	case "limits":
+		list = resources.Limits
+	case "requests":
+		list = resources.Requests
+	}
+	quantity, ok := list[corev1.ResourceName(name)]
+	if !ok {
+		return "", false
+	}
+
+	divisor := int64(1000)
+	if !rule.Divisor.IsZero() {
+		divisor = rule.Divisor.MilliValue()
+	}
+	value := (quantity.MilliValue() + divisor - 1) / divisor
+
+	format := rule.Format
+	if format == "" {
+		format = "%d"
+	}
+	return fmt.Sprintf(format, value), true
+}
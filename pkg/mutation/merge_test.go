@@ -0,0 +1,184 @@
+package mutation
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestMergeEnvKeepsValueFrom(t *testing.T) {
+	podName := corev1.EnvVar{
+		Name:      "POD_NAME",
+		ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}},
+	}
+	memoryLimit := corev1.EnvVar{
+		Name: "MEMORY_LIMIT",
+		ValueFrom: &corev1.EnvVarSource{ResourceFieldRef: &corev1.ResourceFieldSelector{
+			ContainerName: "broker",
+			Resource:      "limits.memory",
+			Divisor:       resource.MustParse("1Mi"),
+		}},
+	}
+
+	env := mergeEnv([]corev1.EnvVar{{Name: "POD_NAME", Value: "static"}}, []corev1.EnvVar{podName, memoryLimit})
+	if len(env) != 2 || !reflect.DeepEqual(env[0], podName) || !reflect.DeepEqual(env[1], memoryLimit) {
+		t.Fatalf("expected [%v %v], got %v", podName, memoryLimit, env)
+	}
+}
+
+func TestMutateEnvFieldRef(t *testing.T) {
+	cfg := testConfig("broker-0", corev1.Container{
+		Name: "broker",
+		Env: []corev1.EnvVar{{
+			Name:      "POD_NAME",
+			ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}},
+		}},
+	})
+	assertPatch(t, mutate(t, testPod("broker-0", "broker"), cfg, Options{}).Patch,
+		`[{"op":"add","path":"/spec/containers/0/env","value":[{"name":"POD_NAME","valueFrom":{"fieldRef":{"fieldPath":"metadata.name"}}}]}]`)
+}
+
+func TestMergeVolumeDevices(t *testing.T) {
+	devices := []corev1.VolumeDevice{{Name: "data", DevicePath: "/dev/old"}, {Name: "logs", DevicePath: "/dev/logs"}}
+	merged := mergeVolumeDevices(devices, []corev1.VolumeDevice{{Name: "data", DevicePath: "/dev/xvda"}, {Name: "spool", DevicePath: "/dev/xvdb"}})
+
+	want := []corev1.VolumeDevice{{Name: "data", DevicePath: "/dev/xvda"}, {Name: "logs", DevicePath: "/dev/logs"}, {Name: "spool", DevicePath: "/dev/xvdb"}}
+	if !reflect.DeepEqual(merged, want) {
+		t.Fatalf("expected %v, got %v", want, merged)
+	}
+}
+
+func TestMutateVolumeDevices(t *testing.T) {
+	cfg := testConfig("broker-0", corev1.Container{
+		Name:          "broker",
+		VolumeDevices: []corev1.VolumeDevice{{Name: "data", DevicePath: "/dev/xvda"}},
+	})
+	assertPatch(t, mutate(t, testPod("broker-0", "broker"), cfg, Options{}).Patch,
+		`[{"op":"add","path":"/spec/containers/0/volumeDevices","value":[{"name":"data","devicePath":"/dev/xvda"}]}]`)
+}
+
+func TestMergeTolerations(t *testing.T) {
+	seconds := int64(300)
+	tolerations := []corev1.Toleration{{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "brokers", Effect: corev1.TaintEffectNoSchedule}}
+	configTolerations := []corev1.Toleration{
+		{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "brokers", Effect: corev1.TaintEffectNoSchedule},
+		{Key: "node.kubernetes.io/unreachable", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoExecute, TolerationSeconds: &seconds},
+	}
+
+	merged, appended := mergeTolerations(tolerations, configTolerations)
+	if !appended || len(merged) != 2 {
+		t.Fatalf("expected the unreachable toleration to be appended, got %v", merged)
+	}
+	if merged[1].TolerationSeconds == nil || *merged[1].TolerationSeconds != 300 {
+		t.Fatalf("expected tolerationSeconds 300 to be kept, got %v", merged[1].TolerationSeconds)
+	}
+	if _, appended := mergeTolerations(merged, configTolerations); appended {
+		t.Fatal("expected no toleration to be appended twice")
+	}
+
+	// a different tolerationSeconds is a different toleration
+	longer := int64(600)
+	configTolerations[1].TolerationSeconds = &longer
+	if merged, appended := mergeTolerations(merged, configTolerations); !appended || len(merged) != 3 {
+		t.Fatalf("expected the toleration with other seconds to be appended, got %v", merged)
+	}
+}
+
+func TestMergeEnvKeepsOrder(t *testing.T) {
+	env := []corev1.EnvVar{
+		{Name: "VAR_A", Value: "a"},
+		{Name: "VAR_B", Value: "$(VAR_A)-b"},
+	}
+	merged := mergeEnv(env, []corev1.EnvVar{
+		{Name: "VAR_C", Value: "c"},
+		{Name: "VAR_A", Value: "x"},
+	})
+
+	var names []string
+	for _, v := range merged {
+		names = append(names, v.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"VAR_A", "VAR_B", "VAR_C"}) {
+		t.Fatalf("expected VAR_A to stay before VAR_B, got %v", names)
+	}
+	if merged[0].Value != "x" {
+		t.Fatalf("expected VAR_A to be replaced in place, got %q", merged[0].Value)
+	}
+}
+
+func TestMergeEnvKeepsOptional(t *testing.T) {
+	optional := true
+	configEnv := []corev1.EnvVar{{
+		Name: "PASSWORD",
+		ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "broker-secrets"},
+			Key:                  "password",
+			Optional:             &optional,
+		}},
+	}}
+
+	merged := mergeEnv([]corev1.EnvVar{{Name: "PASSWORD", Value: "plain"}}, configEnv)
+	ref := merged[0].ValueFrom.SecretKeyRef
+	if ref.Optional == nil || !*ref.Optional {
+		t.Fatalf("expected the secret ref to stay optional, got %v", ref.Optional)
+	}
+
+	// the merged var must not share the config's pointer
+	optional = false
+	if !*ref.Optional {
+		t.Fatal("expected the merged var to hold its own copy of optional")
+	}
+}
+
+func TestMutateEnvKeepsOptional(t *testing.T) {
+	cfg, err := ParsePodDefinition([]byte(`{"metadata":{"name":"broker-0"},"spec":{"containers":[{"name":"broker","env":[
+		{"name":"PASSWORD","valueFrom":{"secretKeyRef":{"name":"broker-secrets","key":"password","optional":true}}},
+		{"name":"MODE","valueFrom":{"configMapKeyRef":{"name":"broker-config","key":"mode","optional":true}}}]}]}}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertPatch(t, mutate(t, testPod("broker-0", "broker"), cfg, Options{}).Patch, `[{"op":"add","path":"/spec/containers/0/env","value":[
+		{"name":"PASSWORD","valueFrom":{"secretKeyRef":{"name":"broker-secrets","key":"password","optional":true}}},
+		{"name":"MODE","valueFrom":{"configMapKeyRef":{"name":"broker-config","key":"mode","optional":true}}}
+	]}]`)
+}
+
+func TestScaleQuantity(t *testing.T) {
+	tests := []struct {
+		name     string
+		resource corev1.ResourceName
+		quantity string
+		factor   float64
+		want     string
+		err      bool
+	}{
+		{name: "memory doubled", resource: corev1.ResourceMemory, quantity: "1Gi", factor: 2, want: "2Gi"},
+		{name: "memory to whole bytes", resource: corev1.ResourceMemory, quantity: "1Gi", factor: 1.1, want: "1181116006"},
+		{name: "memory scaled down", resource: corev1.ResourceMemory, quantity: "1Gi", factor: 0.3, want: "322122547"},
+		{name: "memory in binary units", resource: corev1.ResourceMemory, quantity: "1Gi", factor: 1.5, want: "1536Mi"},
+		{name: "storage to whole bytes", resource: corev1.ResourceEphemeralStorage, quantity: "10G", factor: 0.25, want: "2500M"},
+		{name: "cpu in millicores", resource: corev1.ResourceCPU, quantity: "500m", factor: 1.1, want: "550m"},
+		{name: "cpu rounded to millicores", resource: corev1.ResourceCPU, quantity: "1", factor: 0.3333, want: "333m"},
+		{name: "memory overflow", resource: corev1.ResourceMemory, quantity: "8Ei", factor: 1.5, err: true},
+		{name: "cpu overflow", resource: corev1.ResourceCPU, quantity: "8E", factor: 2, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := scaleQuantity(tt.resource, resource.MustParse(tt.quantity), tt.factor)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", got.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,485 @@
+// Package mutation applies the pod definitions of the webhook's config to pods. It computes
+// the JSON patch the webhook returns to the API server, without any of the HTTP handling.
+package mutation
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mattbaird/jsonpatch"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Logger receives the messages of a mutation, e.g. why a pod was skipped
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+	V(level int) bool
+}
+
+// Options control how a config is applied. The zero value applies the config and
+// writes no annotations of its own.
+type Options struct {
+	// fail when a config container matches none of the pod's containers, instead of warning
+	StrictContainerMatch bool
+
+	// annotation recording that the webhook mutated the pod, written if WriteStatusAnnotation is set
+	WriteStatusAnnotation bool
+	StatusAnnotationKey   string
+
+	// annotation recording Version on mutated pods, not written if empty
+	VersionAnnotationKey string
+	Version              string
+
+	// add the config's ephemeral containers to the pod, which the API server only accepts on existing pods
+	AllowEphemeralContainers bool
+
+	// factor applied to the resource limits and requests set by the config; 1 if unset
+	ResourceMultiplier float64
+
+	// log a readable summary of the changes made to each patched pod
+	LogDiffSummary bool
+
+	// allocatable resources of the cluster's nodes; a pod fitting none of them gets a warning.
+	// Without any nodes, e.g. before the first list returns one, the check is skipped.
+	NodeAllocatable []corev1.ResourceList
+
+	// return notices, e.g. why a pod was skipped, in the result's warnings too
+	NoticesAsWarnings bool
+
+	// receives the log messages; nothing is logged if nil
+	Logger Logger
+}
+
+// Result of a mutation
+type Result struct {
+	// JSON patch for the pod, empty if the config doesn't change it
+	Patch []byte
+
+	// messages for the admission response's warnings
+	Warnings []string
+}
+
+// Logs through the caller's logger and collects the messages returned as warnings
+type mutationLog struct {
+	Logger
+	notices  bool
+	warnings []string
+}
+
+func (l *mutationLog) Noticef(format string, args ...interface{}) {
+	l.Infof(format, args...)
+	if l.notices {
+		l.warnings = append(l.warnings, fmt.Sprintf(format, args...))
+	}
+}
+
+func (l *mutationLog) Warningf(format string, args ...interface{}) {
+	l.Logger.Warningf(format, args...)
+	l.warnings = append(l.warnings, fmt.Sprintf(format, args...))
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Infof(format string, args ...interface{})    {}
+func (nopLogger) Warningf(format string, args ...interface{}) {}
+func (nopLogger) Errorf(format string, args ...interface{})   {}
+func (nopLogger) V(level int) bool                            { return false }
+
+// Mutate computes the JSON patch that applies the matching entry of cfg to the pod. raw is
+// the pod as sent by the API server, if there is one; operations that would not change it
+// are left out. The patch is empty if no entry applies to the pod. cfg is validated first,
+// unless Validate already accepted it.
+func Mutate(pod *corev1.Pod, raw []byte, cfg *Config, opts Options) (Result, error) {
+	logger := &mutationLog{Logger: opts.Logger, notices: opts.NoticesAsWarnings}
+	if logger.Logger == nil {
+		logger.Logger = nopLogger{}
+	}
+	if opts.ResourceMultiplier == 0 {
+		opts.ResourceMultiplier = 1
+	}
+
+	patch, err := mutatePod(logger, pod, raw, cfg, opts)
+	return Result{Patch: patch, Warnings: logger.warnings}, err
+}
+
+func mutatePod(logger *mutationLog, pod *corev1.Pod, raw []byte, cfg *Config, opts Options) ([]byte, error) {
+	initializedPod := pod.DeepCopy()
+
+	// a config validated earlier, e.g. when its file was loaded, isn't checked again
+	if cfg.matchers == nil {
+		validated := *cfg
+		if err := validated.Validate(); err != nil {
+			logger.Errorf("%v", err)
+			return []byte{}, err
+		}
+		cfg = &validated
+	}
+
+	cpod, found := matchConfigPod(pod, cfg.Pods)
+	if !found {
+		logger.Noticef("Pod name is not matching annotation - skipping this pod.")
+		return []byte{}, nil
+	}
+
+	if cpod.CanaryPercent != nil && !inCanary(pod.Name, *cpod.CanaryPercent) {
+		logger.Noticef("Pod %s/%s is outside the %d%% canary - skipping this pod.", pod.Namespace, pod.Name, *cpod.CanaryPercent)
+		return []byte{}, nil
+	}
+
+	cpod, err := expandTemplates(cpod, pod)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return []byte{}, err
+	}
+	cpod = resolveProfile(cpod, cfg.Profiles, pod.Name)
+	if opts.ResourceMultiplier != 1 {
+		if cpod, err = scaleConfigPod(cpod, opts.ResourceMultiplier); err != nil {
+			logger.Errorf("%v", err)
+			return []byte{}, err
+		}
+	}
+
+	// Modify the containers, if the container name of the specification matches
+	// the conainer name of the "initialized pod container name"
+	// Then patch the original pod
+	found = false
+	for _, configContainer := range cpod.Spec.Containers {
+		matched, err := matchesAny(cfg, configContainer.Name, initializedPod.Spec.Containers)
+		if err != nil {
+			logger.Errorf("%v", err)
+			return []byte{}, err
+		}
+		if !matched {
+			if err := unmatchedContainer(logger, opts.StrictContainerMatch, "container", configContainer.Name, pod); err != nil {
+				return []byte{}, err
+			}
+		}
+		found = found || matched
+	}
+	for _, configContainer := range cpod.Spec.InitContainers {
+		matched, err := matchesAny(cfg, configContainer.Name, initializedPod.Spec.InitContainers)
+		if err != nil {
+			logger.Errorf("%v", err)
+			return []byte{}, err
+		}
+		if !matched {
+			if err := unmatchedContainer(logger, opts.StrictContainerMatch, "init container", configContainer.Name, pod); err != nil {
+				return []byte{}, err
+			}
+		}
+		found = found || matched
+	}
+
+	for _, m := range mutatorsFor(logger, cfg, cpod, opts) {
+		if m.Apply(&cpod.Pod, initializedPod) {
+			found = true
+		}
+	}
+
+	if !found {
+		logger.Noticef("No container name is matching annotation - skipping this pod.")
+		return []byte{}, nil
+	}
+
+	if len(opts.NodeAllocatable) > 0 && !fitsAnyNode(podRequests(initializedPod), opts.NodeAllocatable) {
+		logger.Warningf("Pod %s/%s requests more resources than any node can allocate; it may not be scheduled", pod.Namespace, pod.Name)
+	}
+
+	var webhookAnnotations []string
+	if opts.WriteStatusAnnotation {
+		if initializedPod.ObjectMeta.Annotations == nil {
+			initializedPod.ObjectMeta.Annotations = map[string]string{}
+		}
+		initializedPod.ObjectMeta.Annotations[opts.StatusAnnotationKey] = "mutated"
+		webhookAnnotations = append(webhookAnnotations, opts.StatusAnnotationKey)
+	}
+	if opts.VersionAnnotationKey != "" {
+		if initializedPod.ObjectMeta.Annotations == nil {
+			initializedPod.ObjectMeta.Annotations = map[string]string{}
+		}
+		initializedPod.ObjectMeta.Annotations[opts.VersionAnnotationKey] = opts.Version
+		webhookAnnotations = append(webhookAnnotations, opts.VersionAnnotationKey)
+	}
+
+	oldData, err := json.Marshal(pod)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return []byte{}, err
+	}
+
+	newData, err := json.Marshal(initializedPod)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return []byte{}, err
+	}
+
+	patch, err := jsonpatch.CreatePatch(oldData, newData)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return []byte{}, err
+	}
+	// the per-operation check against the request's raw bytes: a replace with the value the
+	// pod already holds is dropped, so re-admitting a converged pod gives an empty patch
+	if pruned := pruneNoopOperations(patch, raw); len(pruned) != len(patch) {
+		if logger.V(2) {
+			logger.Infof("Skipped %d operations for values pod %s/%s already has", len(patch)-len(pruned), pod.Namespace, pod.Name)
+		}
+		patch = pruned
+	}
+	// the webhook's annotations alone are no change, or re-admitting a pod could keep patching it
+	if onlyWebhookAnnotations(patch, webhookAnnotations) {
+		return []byte{}, nil
+	}
+	sortOperations(patch)
+	if len(patch) == 0 {
+		return []byte{}, nil
+	}
+
+	if opts.LogDiffSummary {
+		logger.Infof("%s: %s", pod.Name, diffSummary(pod, initializedPod))
+	}
+
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return []byte{}, err
+	}
+
+	return patchBytes, nil
+}
+
+// Report a config container matching none of the pod's containers.
+// This is an error if strict and a warning otherwise.
+func unmatchedContainer(logger *mutationLog, strict bool, kind string, name string, pod *corev1.Pod) error {
+	err := fmt.Errorf("config %s %q matches no %s of pod %s/%s", kind, name, kind, pod.Namespace, pod.Name)
+	if strict {
+		logger.Errorf("%v", err)
+		return err
+	}
+	logger.Warningf("%v", err)
+	return nil
+}
+
+// Check whether a config container name matches any of the containers
+func matchesAny(cfg *Config, name string, containers []corev1.Container) (bool, error) {
+	matches, err := cfg.matcher(name)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range containers {
+		if matches(c.Name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Check whether the pod name falls into the canary percentage. The choice only
+// depends on the name, so a pod stays in or out of the canary when recreated.
+func inCanary(podName string, percent int) bool {
+	h := fnv.New32a()
+	h.Write([]byte(podName))
+	return int(h.Sum32()%100) < percent
+}
+
+// Find the config pod for the given pod. Entries scoped to the pod's namespace or
+// owner take precedence over an entry matching on name only.
+func matchConfigPod(pod *corev1.Pod, pods []ConfigPod) (ConfigPod, bool) {
+	var best *ConfigPod
+	bestScore := -1
+	for i := range pods {
+		cpod := &pods[i]
+		if !configNameMatches(pod, cpod) {
+			continue
+		}
+		score := 0
+		if cpod.ObjectMeta.Namespace != "" {
+			if cpod.ObjectMeta.Namespace != pod.ObjectMeta.Namespace {
+				continue
+			}
+			score++
+		}
+		if cpod.Owner != "" {
+			if !ownedBy(pod, cpod.Owner) {
+				continue
+			}
+			score++
+		}
+		if score > bestScore {
+			best = cpod
+			bestScore = score
+		}
+	}
+	if best == nil {
+		return ConfigPod{}, false
+	}
+	return *best, true
+}
+
+// Scale the resources of all the config pod's containers by the factor
+func scaleConfigPod(cpod ConfigPod, factor float64) (ConfigPod, error) {
+	var err error
+	if cpod.Spec.Containers, err = scaleResources(cpod.Spec.Containers, factor); err != nil {
+		return cpod, err
+	}
+	if cpod.Spec.InitContainers, err = scaleResources(cpod.Spec.InitContainers, factor); err != nil {
+		return cpod, err
+	}
+	if cpod.ContainersByIndex, err = scaleIndexedResources(cpod.ContainersByIndex, factor); err != nil {
+		return cpod, err
+	}
+	cpod.InitContainersByIndex, err = scaleIndexedResources(cpod.InitContainersByIndex, factor)
+	return cpod, err
+}
+
+// Check whether the config entry names the pod. A pod whose name isn't assigned yet
+// only matches an entry whose generateName is a prefix of the pod's generateName,
+// never an entry without a name.
+func configNameMatches(pod *corev1.Pod, cpod *ConfigPod) bool {
+	if pod.ObjectMeta.Name == "" {
+		return cpod.ObjectMeta.GenerateName != "" &&
+			strings.HasPrefix(pod.ObjectMeta.GenerateName, cpod.ObjectMeta.GenerateName)
+	}
+	return pod.ObjectMeta.Name == cpod.ObjectMeta.Name
+}
+
+// Return the host namespace setting of a config pod, nil if it has none. The wrapper field
+// takes precedence; the pod spec field can only ask for true, as false is its zero value.
+func hostNamespaceSetting(wrapper *bool, spec bool) *bool {
+	if wrapper == nil && spec {
+		return &spec
+	}
+	return wrapper
+}
+
+// Check whether the pod has an owner reference with the given name or UID
+func ownedBy(pod *corev1.Pod, owner string) bool {
+	for _, ref := range pod.ObjectMeta.OwnerReferences {
+		if ref.Name == owner || string(ref.UID) == owner {
+			return true
+		}
+	}
+	return false
+}
+
+// Set the resources of the config containers that don't specify any from the entry's profile,
+// or from the profile of the ordinal range holding the pod's ordinal
+func resolveProfile(cpod ConfigPod, profiles map[string]corev1.ResourceRequirements, podName string) ConfigPod {
+	if ordinal, err := strconv.Atoi(podOrdinal(podName)); err == nil {
+		for _, rule := range cpod.OrdinalProfiles {
+			if ordinal >= rule.From && (rule.To == nil || ordinal <= *rule.To) {
+				cpod.Profile = rule.Profile
+				break
+			}
+		}
+	}
+	if cpod.Profile == "" {
+		return cpod
+	}
+	profile := profiles[cpod.Profile]
+
+	resolve := func(configContainers []corev1.Container) []corev1.Container {
+		resolved := make([]corev1.Container, len(configContainers))
+		for i := range configContainers {
+			resolved[i] = *configContainers[i].DeepCopy()
+			if len(resolved[i].Resources.Limits) == 0 && len(resolved[i].Resources.Requests) == 0 {
+				resolved[i].Resources = *profile.DeepCopy()
+			}
+		}
+		return resolved
+	}
+	cpod.Spec.Containers = resolve(cpod.Spec.Containers)
+	cpod.Spec.InitContainers = resolve(cpod.Spec.InitContainers)
+	return cpod
+}
+
+// NameMatcher returns a matcher for a config container or namespace name. A name wrapped in slashes,
+// e.g. "/.*-broker/", is a regular expression matched against the whole name; otherwise names must be equal.
+func NameMatcher(name string) (func(string) bool, error) {
+	if len(name) < 2 || !strings.HasPrefix(name, "/") || !strings.HasSuffix(name, "/") {
+		return func(s string) bool {
+			return s == name
+		}, nil
+	}
+
+	re, err := regexp.Compile("^(?:" + name[1:len(name)-1] + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid name pattern %s: %v", name, err)
+	}
+	return re.MatchString, nil
+}
+
+// Substitute {{name}}, {{namespace}} and {{ordinal}} in the string fields of the config pod
+func expandTemplates(cpod ConfigPod, pod *corev1.Pod) (ConfigPod, error) {
+	data, err := json.Marshal(cpod)
+	if err != nil {
+		return cpod, err
+	}
+
+	replacer := strings.NewReplacer(
+		"{{name}}", pod.ObjectMeta.Name,
+		"{{namespace}}", pod.ObjectMeta.Namespace,
+		"{{ordinal}}", podOrdinal(pod.ObjectMeta.Name),
+	)
+	var expanded ConfigPod
+	if err := json.Unmarshal([]byte(replacer.Replace(string(data))), &expanded); err != nil {
+		return cpod, err
+	}
+	return expanded, nil
+}
+
+// Return the StatefulSet ordinal of the pod name, e.g. "0" for "broker-0", or "" if there is none
+func podOrdinal(name string) string {
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return ""
+	}
+	if _, err := strconv.Atoi(name[i+1:]); err != nil {
+		return ""
+	}
+	return name[i+1:]
+}
+
+// Total the resources the pod requests: its containers' requests added up, or the
+// largest init container's if that is more
+func podRequests(pod *corev1.Pod) corev1.ResourceList {
+	total := corev1.ResourceList{}
+	for _, c := range pod.Spec.Containers {
+		for name, quantity := range c.Resources.Requests {
+			sum := total[name]
+			sum.Add(quantity)
+			total[name] = sum
+		}
+	}
+	for _, c := range pod.Spec.InitContainers {
+		for name, quantity := range c.Resources.Requests {
+			if current, ok := total[name]; !ok || quantity.Cmp(current) > 0 {
+				total[name] = quantity.DeepCopy()
+			}
+		}
+	}
+	return total
+}
+
+// Check whether any node has allocatable resources for all of the requests
+func fitsAnyNode(requests corev1.ResourceList, nodes []corev1.ResourceList) bool {
+	for _, allocatable := range nodes {
+		fits := true
+		for name, quantity := range requests {
+			if available, ok := allocatable[name]; !ok || available.Cmp(quantity) < 0 {
+				fits = false
+				break
+			}
+		}
+		if fits {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,1022 @@
+package mutation
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	applypatch "github.com/evanphx/json-patch"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Build a pod in the default namespace with containers of the given names
+func testPod(name string, containers ...string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+	}
+	for _, c := range containers {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: c, Image: c + ":1"})
+	}
+	return pod
+}
+
+// Build a config with a single entry for the named pod
+func testConfig(name string, containers ...corev1.Container) *Config {
+	cpod := ConfigPod{}
+	cpod.ObjectMeta.Name = name
+	cpod.Spec.Containers = containers
+	return &Config{Pods: []ConfigPod{cpod}}
+}
+
+// Fail unless the patch holds the same operations as the JSON want, "" for no patch
+func assertPatch(t *testing.T, patch []byte, want string) {
+	t.Helper()
+	if want == "" {
+		if len(patch) != 0 {
+			t.Fatalf("expected no patch, got %s", patch)
+		}
+		return
+	}
+	var got, expected interface{}
+	if err := json.Unmarshal(patch, &got); err != nil {
+		t.Fatalf("invalid patch %q: %v", patch, err)
+	}
+	if err := json.Unmarshal([]byte(want), &expected); err != nil {
+		t.Fatalf("invalid expected patch %q: %v", want, err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected patch %s, got %s", want, patch)
+	}
+}
+
+// Mutate the pod, failing the test on error
+func mutate(t *testing.T, pod *corev1.Pod, cfg *Config, opts Options) Result {
+	t.Helper()
+	result, err := Mutate(pod, nil, cfg, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return result
+}
+
+// Return a copy of the pod with the JSON patch applied
+func applyPatch(t *testing.T, pod *corev1.Pod, patch []byte) *corev1.Pod {
+	t.Helper()
+	data, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) > 0 {
+		decoded, err := applypatch.DecodePatch(patch)
+		if err != nil {
+			t.Fatalf("invalid patch %s: %v", patch, err)
+		}
+		if data, err = decoded.Apply(data); err != nil {
+			t.Fatalf("failed to apply patch %s: %v", patch, err)
+		}
+	}
+	patched := &corev1.Pod{}
+	if err := json.Unmarshal(data, patched); err != nil {
+		t.Fatal(err)
+	}
+	return patched
+}
+
+func TestMutate(t *testing.T) {
+	tests := []struct {
+		name  string
+		pod   *corev1.Pod
+		cfg   *Config
+		opts  Options
+		patch string
+	}{
+		{
+			name:  "image of the named container",
+			pod:   testPod("broker-0", "broker"),
+			cfg:   testConfig("broker-0", corev1.Container{Name: "broker", Image: "broker:2"}),
+			patch: `[{"op":"replace","path":"/spec/containers/0/image","value":"broker:2"}]`,
+		},
+		{
+			name: "no entry for the pod",
+			pod:  testPod("other-0", "broker"),
+			cfg:  testConfig("broker-0", corev1.Container{Name: "broker", Image: "broker:2"}),
+		},
+		{
+			name:  "status annotation",
+			pod:   testPod("broker-0", "broker"),
+			cfg:   testConfig("broker-0", corev1.Container{Name: "broker", Image: "broker:2"}),
+			opts:  Options{WriteStatusAnnotation: true, StatusAnnotationKey: "example.com/status"},
+			patch: `[{"op":"add","path":"/metadata/annotations","value":{"example.com/status":"mutated"}},{"op":"replace","path":"/spec/containers/0/image","value":"broker:2"}]`,
+		},
+		{
+			name: "scaled resources",
+			pod:  testPod("broker-0", "broker"),
+			cfg: testConfig("broker-0", corev1.Container{
+				Name: "broker",
+				Resources: corev1.ResourceRequirements{
+					Limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")},
+				},
+			}),
+			opts:  Options{ResourceMultiplier: 2},
+			patch: `[{"op":"add","path":"/spec/containers/0/resources/limits","value":{"cpu":"2"}}]`,
+		},
+		{
+			name: "config already applied",
+			pod:  testPod("broker-0", "broker"),
+			cfg:  testConfig("broker-0", corev1.Container{Name: "broker", Image: "broker:1"}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Mutate(tt.pod, nil, tt.cfg, tt.opts)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertPatch(t, result.Patch, tt.patch)
+		})
+	}
+}
+
+func TestMutateInvalidConfig(t *testing.T) {
+	cfg := testConfig("broker-0", corev1.Container{Name: "broker", Image: "broker:2"})
+	cfg.Pods = append(cfg.Pods, cfg.Pods[0])
+
+	_, err := Mutate(testPod("broker-0", "broker"), nil, cfg, Options{})
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a *ValidationError, got %v", err)
+	}
+	if len(verr.Causes) != 1 || verr.Causes[0].Type != metav1.CauseTypeFieldValueDuplicate {
+		t.Fatalf("expected one duplicate cause, got %v", verr.Causes)
+	}
+}
+
+func TestMutateDoesNotModifyPod(t *testing.T) {
+	pod := testPod("broker-0", "broker")
+	if _, err := Mutate(pod, nil, testConfig("broker-0", corev1.Container{Name: "broker", Image: "broker:2"}), Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pod.Spec.Containers[0].Image != "broker:1" {
+		t.Fatalf("Mutate changed the pod's image to %s", pod.Spec.Containers[0].Image)
+	}
+}
+
+func TestMutateRegexContainerName(t *testing.T) {
+	cfg := testConfig("broker-0", corev1.Container{Name: "/.*-broker/", Image: "broker:2"})
+
+	pod := testPod("broker-0", "primary-broker", "backup-broker", "monitor")
+	patched := applyPatch(t, pod, mutate(t, pod, cfg, Options{}).Patch)
+	for i, image := range []string{"broker:2", "broker:2", "monitor:1"} {
+		if got := patched.Spec.Containers[i].Image; got != image {
+			t.Errorf("expected image %s for %s, got %s", image, patched.Spec.Containers[i].Name, got)
+		}
+	}
+}
+
+func TestValidateCompilesMatchers(t *testing.T) {
+	cfg := testConfig("broker-0", corev1.Container{Name: "/.*-broker/", Image: "broker:2"})
+	if _, err := Mutate(testPod("broker-0", "primary-broker"), nil, cfg, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.matchers != nil {
+		t.Fatal("expected Mutate to leave the caller's config alone")
+	}
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	matches, ok := cfg.matchers["/.*-broker/"]
+	if !ok || !matches("primary-broker") || matches("monitor") {
+		t.Fatalf("expected a compiled matcher for /.*-broker/, got %v", cfg.matchers)
+	}
+}
+
+func TestValidateInvalidContainerName(t *testing.T) {
+	cfg := testConfig("broker-0", corev1.Container{Name: "/broker(/"})
+	verr, ok := cfg.Validate().(*ValidationError)
+	if !ok || len(verr.Causes) != 1 || verr.Causes[0].Field != "Pods[0].spec.containers[0].name" {
+		t.Fatalf("expected an invalid container name cause, got %v", verr)
+	}
+	if cfg.matchers != nil {
+		t.Fatal("expected no matchers for an invalid config")
+	}
+}
+
+func TestMutatePrefersNamespaceEntry(t *testing.T) {
+	cfg := &Config{}
+	for _, namespace := range []string{"", "dev", "prod"} {
+		cpod := ConfigPod{}
+		cpod.Name = "broker-0"
+		cpod.Namespace = namespace
+		cpod.Spec.Containers = []corev1.Container{{Name: "broker", Image: "broker:" + namespace + "2"}}
+		cfg.Pods = append(cfg.Pods, cpod)
+	}
+
+	for namespace, image := range map[string]string{"dev": "broker:dev2", "prod": "broker:prod2", "test": "broker:2"} {
+		pod := testPod("broker-0", "broker")
+		pod.Namespace = namespace
+		patched := applyPatch(t, pod, mutate(t, pod, cfg, Options{}).Patch)
+		if got := patched.Spec.Containers[0].Image; got != image {
+			t.Errorf("expected image %s in namespace %s, got %s", image, namespace, got)
+		}
+	}
+}
+
+func TestMutateExpandsTemplates(t *testing.T) {
+	cfg := testConfig("broker-0", corev1.Container{
+		Name: "broker",
+		Env: []corev1.EnvVar{
+			{Name: "MEMBER_ID", Value: "{{ordinal}}"},
+			{Name: "MEMBER_NAME", Value: "{{name}}.{{namespace}}"},
+		},
+	})
+
+	pod := testPod("broker-0", "broker")
+	patched := applyPatch(t, pod, mutate(t, pod, cfg, Options{}).Patch)
+	env := patched.Spec.Containers[0].Env
+	if len(env) != 2 || env[0].Value != "0" || env[1].Value != "broker-0.default" {
+		t.Fatalf("expected MEMBER_ID=0 and MEMBER_NAME=broker-0.default, got %v", env)
+	}
+}
+
+func TestMutateNodeName(t *testing.T) {
+	cfg := testConfig("broker-0")
+	cfg.Pods[0].Spec.NodeName = "node-1"
+	result := mutate(t, testPod("broker-0", "broker"), cfg, Options{})
+	assertPatch(t, result.Patch, `[{"op":"add","path":"/spec/nodeName","value":"node-1"}]`)
+	if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], "bypasses the scheduler") {
+		t.Fatalf("expected a warning about bypassing the scheduler, got %v", result.Warnings)
+	}
+
+	cfg = testConfig("broker-0", corev1.Container{Name: "broker", Image: "broker:2"})
+	result = mutate(t, testPod("broker-0", "broker"), cfg, Options{})
+	assertPatch(t, result.Patch, `[{"op":"replace","path":"/spec/containers/0/image","value":"broker:2"}]`)
+}
+
+func TestMutateImageOverride(t *testing.T) {
+	cfg := testConfig("broker-0", corev1.Container{Name: "monitor", Image: "monitor:2"})
+	cfg.Pods[0].ImageOverride = "pinned:1"
+
+	pod := testPod("broker-0", "broker", "sidecar", "monitor")
+	pod.Spec.InitContainers = []corev1.Container{{Name: "setup", Image: "setup:1"}}
+	patched := applyPatch(t, pod, mutate(t, pod, cfg, Options{}).Patch)
+	for i, image := range []string{"pinned:1", "pinned:1", "monitor:2"} {
+		if got := patched.Spec.Containers[i].Image; got != image {
+			t.Errorf("expected image %s for %s, got %s", image, patched.Spec.Containers[i].Name, got)
+		}
+	}
+	if got := patched.Spec.InitContainers[0].Image; got != "pinned:1" {
+		t.Errorf("expected image pinned:1 for init container setup, got %s", got)
+	}
+}
+
+func TestMutateImageKeepsResources(t *testing.T) {
+	pod := testPod("broker-0", "broker")
+	pod.Spec.Containers[0].Resources.Limits = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("2")}
+
+	cfg := testConfig("broker-0", corev1.Container{Name: "broker", Image: "broker:2"})
+	assertPatch(t, mutate(t, pod, cfg, Options{}).Patch,
+		`[{"op":"replace","path":"/spec/containers/0/image","value":"broker:2"}]`)
+}
+
+func TestMutateOwnerReferences(t *testing.T) {
+	owner := metav1.OwnerReference{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "broker-v2", UID: "uid-2"}
+	cfg := testConfig("broker-0")
+	cfg.Pods[0].OwnerReferences = []metav1.OwnerReference{owner}
+
+	pod := testPod("broker-0", "broker")
+	pod.OwnerReferences = []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "broker", UID: "uid-1"}}
+	result := mutate(t, pod, cfg, Options{})
+	patched := applyPatch(t, pod, result.Patch)
+	if len(patched.OwnerReferences) != 1 || patched.OwnerReferences[0] != owner {
+		t.Fatalf("expected owner references [%v], got %v", owner, patched.OwnerReferences)
+	}
+	if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], "garbage collected") {
+		t.Fatalf("expected a warning about garbage collection, got %v", result.Warnings)
+	}
+
+	cfg = testConfig("broker-0", corev1.Container{Name: "broker", Image: "broker:2"})
+	patched = applyPatch(t, pod, mutate(t, pod, cfg, Options{}).Patch)
+	if len(patched.OwnerReferences) != 1 || patched.OwnerReferences[0].UID != "uid-1" {
+		t.Fatalf("expected the pod's owner references to be kept, got %v", patched.OwnerReferences)
+	}
+}
+
+func TestMutateHostname(t *testing.T) {
+	cfg := testConfig("broker-0")
+	cfg.Pods[0].Spec.Hostname = "primary"
+	assertPatch(t, mutate(t, testPod("broker-0", "broker"), cfg, Options{}).Patch,
+		`[{"op":"add","path":"/spec/hostname","value":"primary"}]`)
+}
+
+func TestMutateSubdomain(t *testing.T) {
+	cfg := testConfig("broker-0")
+	cfg.Pods[0].Spec.Subdomain = "brokers"
+	assertPatch(t, mutate(t, testPod("broker-0", "broker"), cfg, Options{}).Patch,
+		`[{"op":"add","path":"/spec/subdomain","value":"brokers"}]`)
+}
+
+func TestMutateAutomountServiceAccountToken(t *testing.T) {
+	automount := false
+	cfg := testConfig("broker-0")
+	cfg.Pods[0].Spec.AutomountServiceAccountToken = &automount
+	assertPatch(t, mutate(t, testPod("broker-0", "broker"), cfg, Options{}).Patch,
+		`[{"op":"add","path":"/spec/automountServiceAccountToken","value":false}]`)
+
+	cfg = testConfig("broker-0", corev1.Container{Name: "broker", Image: "broker:2"})
+	assertPatch(t, mutate(t, testPod("broker-0", "broker"), cfg, Options{}).Patch,
+		`[{"op":"replace","path":"/spec/containers/0/image","value":"broker:2"}]`)
+}
+
+func TestMutateHostNamespaces(t *testing.T) {
+	enabled := true
+	tests := []struct {
+		name  string
+		set   func(cpod *ConfigPod)
+		patch string
+	}{
+		{"hostNetwork", func(cpod *ConfigPod) { cpod.HostNetwork = &enabled }, `[{"op":"add","path":"/spec/hostNetwork","value":true}]`},
+		{"hostPID", func(cpod *ConfigPod) { cpod.HostPID = &enabled }, `[{"op":"add","path":"/spec/hostPID","value":true}]`},
+		{"hostIPC", func(cpod *ConfigPod) { cpod.HostIPC = &enabled }, `[{"op":"add","path":"/spec/hostIPC","value":true}]`},
+		{"spec.hostNetwork", func(cpod *ConfigPod) { cpod.Spec.HostNetwork = true }, `[{"op":"add","path":"/spec/hostNetwork","value":true}]`},
+		{"spec.hostPID", func(cpod *ConfigPod) { cpod.Spec.HostPID = true }, `[{"op":"add","path":"/spec/hostPID","value":true}]`},
+		{"spec.hostIPC", func(cpod *ConfigPod) { cpod.Spec.HostIPC = true }, `[{"op":"add","path":"/spec/hostIPC","value":true}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig("broker-0")
+			tt.set(&cfg.Pods[0])
+			result := mutate(t, testPod("broker-0", "broker"), cfg, Options{})
+			assertPatch(t, result.Patch, tt.patch)
+			if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], "privileged") {
+				t.Fatalf("expected a warning about the privileged setting, got %v", result.Warnings)
+			}
+		})
+	}
+}
+
+func TestMutateHostNetworkFalse(t *testing.T) {
+	disabled := false
+	cfg := testConfig("broker-0")
+	cfg.Pods[0].HostNetwork = &disabled
+
+	pod := testPod("broker-0", "broker")
+	pod.Spec.HostNetwork = true
+	assertPatch(t, mutate(t, pod, cfg, Options{}).Patch, `[{"op":"remove","path":"/spec/hostNetwork"}]`)
+}
+
+func TestMutateOnlyIfLessThan(t *testing.T) {
+	cfg := testConfig("broker-0", corev1.Container{
+		Name: "broker",
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("2Gi")},
+		},
+	})
+	cfg.Pods[0].ResourcesPolicy = ResourcesPolicyOnlyIfLessThan
+
+	tuned := testPod("broker-0", "broker")
+	tuned.Spec.Containers[0].Resources.Limits = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("4Gi")}
+	assertPatch(t, mutate(t, tuned, cfg, Options{}).Patch, "")
+
+	small := testPod("broker-0", "broker")
+	small.Spec.Containers[0].Resources.Limits = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")}
+	assertPatch(t, mutate(t, small, cfg, Options{}).Patch,
+		`[{"op":"replace","path":"/spec/containers/0/resources/limits/memory","value":"2Gi"}]`)
+}
+
+func TestMutateInitContainers(t *testing.T) {
+	cfg := testConfig("broker-0")
+	cfg.Pods[0].Spec.InitContainers = []corev1.Container{{
+		Name:  "setup",
+		Image: "setup:2",
+		Env:   []corev1.EnvVar{{Name: "MODE", Value: "cluster"}},
+	}}
+
+	pod := testPod("broker-0", "broker")
+	pod.Spec.InitContainers = []corev1.Container{{Name: "setup", Image: "setup:1", Env: []corev1.EnvVar{{Name: "DEBUG", Value: "1"}}}}
+	patched := applyPatch(t, pod, mutate(t, pod, cfg, Options{}).Patch)
+
+	setup := patched.Spec.InitContainers[0]
+	if setup.Image != "setup:2" {
+		t.Errorf("expected init container image setup:2, got %s", setup.Image)
+	}
+	want := []corev1.EnvVar{{Name: "DEBUG", Value: "1"}, {Name: "MODE", Value: "cluster"}}
+	if !reflect.DeepEqual(setup.Env, want) {
+		t.Errorf("expected init container env %v, got %v", want, setup.Env)
+	}
+	if patched.Spec.Containers[0].Image != "broker:1" {
+		t.Errorf("expected the broker container to be unchanged, got image %s", patched.Spec.Containers[0].Image)
+	}
+}
+
+func TestMutateUnmatchedContainer(t *testing.T) {
+	cfg := testConfig("broker-0",
+		corev1.Container{Name: "broker", Image: "broker:2"},
+		corev1.Container{Name: "brokr", Image: "broker:2"})
+
+	result := mutate(t, testPod("broker-0", "broker"), cfg, Options{})
+	assertPatch(t, result.Patch, `[{"op":"replace","path":"/spec/containers/0/image","value":"broker:2"}]`)
+	if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], `"brokr"`) {
+		t.Fatalf("expected a warning naming brokr, got %v", result.Warnings)
+	}
+
+	_, err := Mutate(testPod("broker-0", "broker"), nil, cfg, Options{StrictContainerMatch: true})
+	if err == nil || !strings.Contains(err.Error(), `config container "brokr" matches no container of pod default/broker-0`) {
+		t.Fatalf("expected an error naming brokr, got %v", err)
+	}
+}
+
+func TestMutateEnableServiceLinks(t *testing.T) {
+	enableServiceLinks := false
+	cfg := testConfig("broker-0")
+	cfg.Pods[0].Spec.EnableServiceLinks = &enableServiceLinks
+	assertPatch(t, mutate(t, testPod("broker-0", "broker"), cfg, Options{}).Patch,
+		`[{"op":"add","path":"/spec/enableServiceLinks","value":false}]`)
+
+	cfg = testConfig("broker-0", corev1.Container{Name: "broker", Image: "broker:2"})
+	assertPatch(t, mutate(t, testPod("broker-0", "broker"), cfg, Options{}).Patch,
+		`[{"op":"replace","path":"/spec/containers/0/image","value":"broker:2"}]`)
+}
+
+func TestMutateMatchesOwner(t *testing.T) {
+	cfg := &Config{}
+	for _, owner := range []string{"tenant-a", "uid-b"} {
+		cpod := ConfigPod{Owner: owner}
+		cpod.Name = "broker-0"
+		cpod.Spec.Containers = []corev1.Container{{Name: "broker", Image: "broker:" + owner}}
+		cfg.Pods = append(cfg.Pods, cpod)
+	}
+
+	tenantA := testPod("broker-0", "broker")
+	tenantA.OwnerReferences = []metav1.OwnerReference{{Kind: "StatefulSet", Name: "tenant-a", UID: "uid-a"}}
+	tenantB := testPod("broker-0", "broker")
+	tenantB.OwnerReferences = []metav1.OwnerReference{{Kind: "StatefulSet", Name: "tenant-b", UID: "uid-b"}}
+
+	for pod, image := range map[*corev1.Pod]string{tenantA: "broker:tenant-a", tenantB: "broker:uid-b"} {
+		patched := applyPatch(t, pod, mutate(t, pod, cfg, Options{}).Patch)
+		if got := patched.Spec.Containers[0].Image; got != image {
+			t.Errorf("expected image %s for the pod owned by %s, got %s", image, pod.OwnerReferences[0].Name, got)
+		}
+	}
+
+	unowned := testPod("broker-0", "broker")
+	assertPatch(t, mutate(t, unowned, cfg, Options{}).Patch, "")
+}
+
+func TestMutateDiffsAgainstRaw(t *testing.T) {
+	cfg := testConfig("broker-0", corev1.Container{Name: "broker", Image: "broker:2", Env: []corev1.EnvVar{{Name: "MODE", Value: "cluster"}}})
+
+	// the API server's object already has the image the decoded pod lacks
+	pod := testPod("broker-0", "broker")
+	raw := []byte(`{"metadata":{"name":"broker-0","namespace":"default"},"spec":{"containers":[{"name":"broker","image":"broker:2"}]}}`)
+	result, err := Mutate(pod, raw, cfg, Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertPatch(t, result.Patch, `[{"op":"add","path":"/spec/containers/0/env","value":[{"name":"MODE","value":"cluster"}]}]`)
+}
+
+func TestMutateInsertInitContainer(t *testing.T) {
+	cfg := testConfig("broker-0")
+	cfg.Pods[0].InsertInitContainers = []InitContainerInsert{{Index: 0, Container: corev1.Container{Name: "proxy", Image: "proxy:1"}}}
+
+	pod := testPod("broker-0", "broker")
+	pod.Spec.InitContainers = []corev1.Container{{Name: "setup", Image: "setup:1"}, {Name: "migrate", Image: "migrate:1"}}
+	patched := applyPatch(t, pod, mutate(t, pod, cfg, Options{}).Patch)
+
+	var names []string
+	for _, c := range patched.Spec.InitContainers {
+		names = append(names, c.Name)
+	}
+	if strings.Join(names, ",") != "proxy,setup,migrate" {
+		t.Fatalf("expected init containers proxy,setup,migrate, got %v", names)
+	}
+
+	// inserting is idempotent, the container is only added once
+	assertPatch(t, mutate(t, patched, cfg, Options{}).Patch, "")
+}
+
+func TestMutateResourceProfile(t *testing.T) {
+	large := corev1.ResourceRequirements{
+		Limits:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("4"), corev1.ResourceMemory: resource.MustParse("8Gi")},
+		Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("2"), corev1.ResourceMemory: resource.MustParse("8Gi")},
+	}
+	cfg := testConfig("broker-0", corev1.Container{Name: "broker"})
+	cfg.Pods[0].Profile = "large"
+	cfg.Profiles = map[string]corev1.ResourceRequirements{"large": large}
+
+	pod := testPod("broker-0", "broker")
+	patched := applyPatch(t, pod, mutate(t, pod, cfg, Options{}).Patch)
+	if got := patched.Spec.Containers[0].Resources; !apiequality.Semantic.DeepEqual(got, large) {
+		t.Fatalf("expected resources %v, got %v", large, got)
+	}
+}
+
+func TestMutateUnknownProfile(t *testing.T) {
+	cfg := testConfig("broker-0", corev1.Container{Name: "broker"})
+	cfg.Pods[0].Profile = "huge"
+	if _, err := Mutate(testPod("broker-0", "broker"), nil, cfg, Options{}); err == nil || !strings.Contains(err.Error(), `unknown profile "huge"`) {
+		t.Fatalf("expected an unknown profile error, got %v", err)
+	}
+}
+
+func TestMutateSecondAdmission(t *testing.T) {
+	cfg := testConfig("broker-0", corev1.Container{
+		Name:  "broker",
+		Image: "broker:2",
+		Env:   []corev1.EnvVar{{Name: "NODE_ROLE", Value: "primary"}},
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("2Gi")},
+		},
+	})
+	cfg.Pods[0].Labels = map[string]string{"member-id": "{{ordinal}}"}
+	opts := Options{WriteStatusAnnotation: true, StatusAnnotationKey: "example.com/status"}
+
+	pod := testPod("broker-0", "broker")
+	first := mutate(t, pod, cfg, opts)
+	if len(first.Patch) == 0 {
+		t.Fatal("expected a patch on the first admission")
+	}
+
+	patched := applyPatch(t, pod, first.Patch)
+	raw, err := json.Marshal(patched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Mutate(patched, raw, cfg, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertPatch(t, second.Patch, "")
+}
+
+func TestMutateShareProcessNamespace(t *testing.T) {
+	share := true
+	cfg := testConfig("broker-0")
+	cfg.Pods[0].Spec.ShareProcessNamespace = &share
+	assertPatch(t, mutate(t, testPod("broker-0", "broker"), cfg, Options{}).Patch,
+		`[{"op":"add","path":"/spec/shareProcessNamespace","value":true}]`)
+
+	cfg = testConfig("broker-0", corev1.Container{Name: "broker", Image: "broker:2"})
+	assertPatch(t, mutate(t, testPod("broker-0", "broker"), cfg, Options{}).Patch,
+		`[{"op":"replace","path":"/spec/containers/0/image","value":"broker:2"}]`)
+}
+
+func BenchmarkMutateLargePod(b *testing.B) {
+	pod := testPod("broker-0")
+	for i := 0; i < 20; i++ {
+		c := corev1.Container{Name: "broker-" + strconv.Itoa(i), Image: "broker:1"}
+		for j := 0; j < 50; j++ {
+			c.Env = append(c.Env, corev1.EnvVar{Name: "VAR_" + strconv.Itoa(j), Value: "value"})
+		}
+		pod.Spec.Containers = append(pod.Spec.Containers, c)
+	}
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		b.Fatal(err)
+	}
+	cfg := testConfig("broker-0", corev1.Container{Name: "/broker-.*/", Image: "broker:2"})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		result, err := Mutate(pod, raw, cfg, Options{})
+		if err != nil || len(result.Patch) == 0 {
+			b.Fatalf("expected a patch, got %v", err)
+		}
+	}
+}
+
+func TestMutateEphemeralContainers(t *testing.T) {
+	cfg := testConfig("broker-0")
+	cfg.Pods[0].Spec.EphemeralContainers = []corev1.EphemeralContainer{{
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debug", Image: "busybox"},
+	}}
+
+	result := mutate(t, testPod("broker-0", "broker"), cfg, Options{})
+	assertPatch(t, result.Patch, "")
+	if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], "Ignoring ephemeral containers") {
+		t.Fatalf("expected a warning about ignored ephemeral containers, got %v", result.Warnings)
+	}
+
+	result = mutate(t, testPod("broker-0", "broker"), cfg, Options{AllowEphemeralContainers: true})
+	assertPatch(t, result.Patch,
+		`[{"op":"add","path":"/spec/ephemeralContainers","value":[{"name":"debug","image":"busybox","resources":{}}]}]`)
+}
+
+func TestMutateResizePolicy(t *testing.T) {
+	cfg := testConfig("broker-0", corev1.Container{
+		Name:         "broker",
+		ResizePolicy: []corev1.ContainerResizePolicy{{ResourceName: corev1.ResourceCPU, RestartPolicy: corev1.NotRequired}},
+	})
+	assertPatch(t, mutate(t, testPod("broker-0", "broker"), cfg, Options{}).Patch,
+		`[{"op":"add","path":"/spec/containers/0/resizePolicy","value":[{"resourceName":"cpu","restartPolicy":"NotRequired"}]}]`)
+}
+
+func TestInCanary(t *testing.T) {
+	for _, name := range []string{"broker-0", "broker-1", "broker-2", "broker-3"} {
+		if inCanary(name, 0) {
+			t.Errorf("expected %s outside a 0%% canary", name)
+		}
+		if !inCanary(name, 100) {
+			t.Errorf("expected %s inside a 100%% canary", name)
+		}
+	}
+
+	// fnv32a of the name modulo 100
+	h := fnv.New32a()
+	h.Write([]byte("broker-0"))
+	bucket := int(h.Sum32() % 100)
+	if inCanary("broker-0", bucket) || !inCanary("broker-0", bucket+1) {
+		t.Fatalf("expected broker-0 in canaries above %d%% only", bucket)
+	}
+}
+
+func TestMutateCanary(t *testing.T) {
+	cfg := testConfig("broker-0", corev1.Container{Name: "broker", Image: "broker:2"})
+	percent := 0
+	cfg.Pods[0].CanaryPercent = &percent
+	assertPatch(t, mutate(t, testPod("broker-0", "broker"), cfg, Options{}).Patch, "")
+
+	percent = 100
+	assertPatch(t, mutate(t, testPod("broker-0", "broker"), cfg, Options{}).Patch,
+		`[{"op":"replace","path":"/spec/containers/0/image","value":"broker:2"}]`)
+}
+
+func TestMutateContainerOrder(t *testing.T) {
+	cfg := testConfig("broker-0")
+	cfg.Pods[0].ContainerOrder = []string{"proxy", "broker"}
+
+	pod := testPod("broker-0", "broker", "monitor", "proxy")
+	patched := applyPatch(t, pod, mutate(t, pod, cfg, Options{}).Patch)
+
+	var names []string
+	for _, c := range patched.Spec.Containers {
+		names = append(names, c.Name)
+	}
+	if strings.Join(names, ",") != "proxy,broker,monitor" {
+		t.Fatalf("expected containers proxy,broker,monitor, got %v", names)
+	}
+	if patched.Spec.Containers[0].Image != "proxy:1" {
+		t.Fatalf("expected containers to move along with their fields, got %v", patched.Spec.Containers[0])
+	}
+}
+
+func TestMutateGenerateName(t *testing.T) {
+	cpod := ConfigPod{}
+	cpod.GenerateName = "loader-"
+	cpod.Spec.Containers = []corev1.Container{{Name: "loader", Image: "loader:2"}}
+	cfg := &Config{Pods: []ConfigPod{cpod}}
+
+	pod := testPod("", "loader")
+	pod.GenerateName = "loader-7d9f-"
+	assertPatch(t, mutate(t, pod, cfg, Options{}).Patch,
+		`[{"op":"replace","path":"/spec/containers/0/image","value":"loader:2"}]`)
+
+	other := testPod("", "loader")
+	other.GenerateName = "other-"
+	assertPatch(t, mutate(t, other, cfg, Options{}).Patch, "")
+}
+
+func TestMutateGenerateNameUnnamedEntry(t *testing.T) {
+	// an entry scoped by owner only has an empty name, it must not match an unnamed pod
+	cpod := ConfigPod{Owner: "loader"}
+	cpod.Spec.Containers = []corev1.Container{{Name: "loader", Image: "loader:2"}}
+	cfg := &Config{Pods: []ConfigPod{cpod}}
+
+	pod := testPod("", "loader")
+	pod.GenerateName = "loader-7d9f-"
+	pod.OwnerReferences = []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "loader", UID: "uid-loader"}}
+	assertPatch(t, mutate(t, pod, cfg, Options{}).Patch, "")
+}
+
+func TestMutateDerivedEnv(t *testing.T) {
+	cfg := testConfig("broker-0", corev1.Container{
+		Name: "broker",
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("2"), corev1.ResourceMemory: resource.MustParse("2Gi")},
+		},
+	})
+	cfg.Pods[0].DerivedEnv = []DerivedEnv{
+		{Name: "GOMAXPROCS", Resource: "limits.cpu"},
+		{Name: "JAVA_OPTS", Container: "/broker|monitor/", Resource: "limits.memory", Divisor: resource.MustParse("1Mi"), Format: "-Xmx%dm"},
+	}
+
+	pod := testPod("broker-0", "broker", "sidecar")
+	patched := applyPatch(t, pod, mutate(t, pod, cfg, Options{}).Patch)
+	want := []corev1.EnvVar{{Name: "GOMAXPROCS", Value: "2"}, {Name: "JAVA_OPTS", Value: "-Xmx2048m"}}
+	if got := patched.Spec.Containers[0].Env; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected env %v, got %v", want, got)
+	}
+	// the sidecar has no limits to derive from
+	if got := patched.Spec.Containers[1].Env; len(got) != 0 {
+		t.Fatalf("expected no env on the sidecar, got %v", got)
+	}
+}
+
+func TestDerivedValueRoundsUp(t *testing.T) {
+	resources := corev1.ResourceRequirements{
+		Limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1500m")},
+	}
+	if value, ok := derivedValue(resources, DerivedEnv{Resource: "limits.cpu"}); !ok || value != "2" {
+		t.Fatalf("expected 2, got %q (%v)", value, ok)
+	}
+	if _, ok := derivedValue(resources, DerivedEnv{Resource: "requests.cpu"}); ok {
+		t.Fatal("expected no value for an unset request")
+	}
+}
+
+func TestMutateOrdinalProfiles(t *testing.T) {
+	small := corev1.ResourceRequirements{Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")}}
+	large := corev1.ResourceRequirements{Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("4Gi")}}
+	to := 2
+
+	for name, want := range map[string]string{"broker-1": "1Gi", "broker-5": "4Gi"} {
+		cfg := testConfig(name, corev1.Container{Name: "broker"})
+		cfg.Profiles = map[string]corev1.ResourceRequirements{"A": small, "B": large}
+		cfg.Pods[0].OrdinalProfiles = []OrdinalProfile{{From: 0, To: &to, Profile: "A"}, {From: 3, Profile: "B"}}
+
+		pod := testPod(name, "broker")
+		patched := applyPatch(t, pod, mutate(t, pod, cfg, Options{}).Patch)
+		if got := patched.Spec.Containers[0].Resources.Limits[corev1.ResourceMemory]; got.String() != want {
+			t.Errorf("expected a %s memory limit for %s, got %s", want, name, got.String())
+		}
+	}
+}
+
+func TestMutateTemplatedLabel(t *testing.T) {
+	cfg := testConfig("broker-3")
+	cfg.Pods[0].Labels = map[string]string{"member-id": "{{ordinal}}"}
+	assertPatch(t, mutate(t, testPod("broker-3", "broker"), cfg, Options{}).Patch,
+		`[{"op":"add","path":"/metadata/labels","value":{"member-id":"3"}}]`)
+}
+
+func TestMutateTerminationMessagePolicy(t *testing.T) {
+	cfg := testConfig("broker-0", corev1.Container{Name: "broker", TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError})
+	assertPatch(t, mutate(t, testPod("broker-0", "broker"), cfg, Options{}).Patch,
+		`[{"op":"add","path":"/spec/containers/0/terminationMessagePolicy","value":"FallbackToLogsOnError"}]`)
+}
+
+func TestMutateResourceMultiplier(t *testing.T) {
+	cfg := testConfig("broker-0", corev1.Container{
+		Name: "broker",
+		Resources: corev1.ResourceRequirements{
+			Limits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+			Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m")},
+		},
+	})
+
+	pod := testPod("broker-0", "broker")
+	patched := applyPatch(t, pod, mutate(t, pod, cfg, Options{ResourceMultiplier: 2}).Patch)
+	resources := patched.Spec.Containers[0].Resources
+	if memory := resources.Limits[corev1.ResourceMemory]; memory.String() != "2Gi" {
+		t.Errorf("expected a 2Gi memory limit, got %s", memory.String())
+	}
+	if cpu := resources.Requests[corev1.ResourceCPU]; cpu.String() != "1" {
+		t.Errorf("expected a cpu request of 1, got %s", cpu.String())
+	}
+
+	// the config itself is left alone
+	if memory := cfg.Pods[0].Spec.Containers[0].Resources.Limits[corev1.ResourceMemory]; memory.String() != "1Gi" {
+		t.Errorf("expected the config to keep its 1Gi limit, got %s", memory.String())
+	}
+}
+
+func TestMutateAlreadyAnnotatedPod(t *testing.T) {
+	cfg := testConfig("broker-0", corev1.Container{Name: "broker", Image: "broker:2"})
+	opts := Options{
+		WriteStatusAnnotation: true,
+		StatusAnnotationKey:   "example.com/status",
+		VersionAnnotationKey:  "example.com/version",
+		Version:               "v2",
+	}
+
+	// mutated by an earlier build, only the webhook's annotations would change
+	pod := testPod("broker-0", "broker")
+	pod.Spec.Containers[0].Image = "broker:2"
+	pod.Annotations = map[string]string{"example.com/status": "mutated", "example.com/version": "v1"}
+	assertPatch(t, mutate(t, pod, cfg, opts).Patch, "")
+
+	// the annotations alone are no reason to patch a pod the config doesn't change
+	unannotated := testPod("broker-0", "broker")
+	unannotated.Spec.Containers[0].Image = "broker:2"
+	assertPatch(t, mutate(t, unannotated, cfg, opts).Patch, "")
+}
+
+func TestMutateOnlyIfUnset(t *testing.T) {
+	cfg := testConfig("broker-0", corev1.Container{
+		Name: "/.*/",
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("512Mi")},
+		},
+	})
+	cfg.Pods[0].ResourcesPolicy = ResourcesPolicyOnlyIfUnset
+
+	pod := testPod("broker-0", "broker", "sidecar")
+	pod.Spec.Containers[0].Resources.Requests = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}
+	assertPatch(t, mutate(t, pod, cfg, Options{}).Patch,
+		`[{"op":"add","path":"/spec/containers/1/resources/requests","value":{"memory":"512Mi"}}]`)
+}
+
+func TestMutateSysctls(t *testing.T) {
+	cfg := testConfig("broker-0")
+	cfg.Pods[0].Spec.SecurityContext = &corev1.PodSecurityContext{
+		Sysctls: []corev1.Sysctl{{Name: "net.core.somaxconn", Value: "1024"}},
+	}
+	assertPatch(t, mutate(t, testPod("broker-0", "broker"), cfg, Options{}).Patch,
+		`[{"op":"add","path":"/spec/securityContext","value":{"sysctls":[{"name":"net.core.somaxconn","value":"1024"}]}}]`)
+}
+
+func TestMergeSysctls(t *testing.T) {
+	sysctls := []corev1.Sysctl{{Name: "net.core.somaxconn", Value: "128"}, {Name: "kernel.shm_rmid_forced", Value: "1"}}
+	merged := mergeSysctls(sysctls, []corev1.Sysctl{{Name: "net.core.somaxconn", Value: "1024"}, {Name: "net.ipv4.tcp_syncookies", Value: "1"}})
+
+	want := []corev1.Sysctl{{Name: "net.core.somaxconn", Value: "1024"}, {Name: "kernel.shm_rmid_forced", Value: "1"}, {Name: "net.ipv4.tcp_syncookies", Value: "1"}}
+	if !reflect.DeepEqual(merged, want) {
+		t.Fatalf("expected %v, got %v", want, merged)
+	}
+}
+
+func TestMutateExtendedResources(t *testing.T) {
+	gpu := corev1.ResourceName("nvidia.com/gpu")
+	cfg := testConfig("broker-0", corev1.Container{
+		Name: "broker",
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{gpu: resource.MustParse("1")},
+		},
+	})
+	cfg.Pods[0].ResourcesPolicy = ResourcesPolicyOnlyIfLessThan
+
+	pod := testPod("broker-0", "broker")
+	pod.Spec.Containers[0].Resources.Limits = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")}
+	assertPatch(t, mutate(t, pod, cfg, Options{}).Patch,
+		`[{"op":"add","path":"/spec/containers/0/resources/limits/nvidia.com~1gpu","value":"1"}]`)
+}
+
+func TestMutateRemoveLabelsAndAnnotations(t *testing.T) {
+	cfg := testConfig("broker-0")
+	cfg.Pods[0].RemoveLabels = []string{"bad", "missing"}
+	cfg.Pods[0].RemoveAnnotations = []string{"example.com/stale"}
+
+	pod := testPod("broker-0", "broker")
+	pod.Labels = map[string]string{"app": "broker", "bad": "true"}
+	pod.Annotations = map[string]string{"example.com/stale": "1", "example.com/keep": "1"}
+	assertPatch(t, mutate(t, pod, cfg, Options{}).Patch, `[
+		{"op":"remove","path":"/metadata/annotations/example.com~1stale"},
+		{"op":"remove","path":"/metadata/labels/bad"}
+	]`)
+}
+
+func TestMutateVersionAnnotation(t *testing.T) {
+	cfg := testConfig("broker-0", corev1.Container{Name: "broker", Image: "broker:2"})
+	opts := Options{VersionAnnotationKey: "pod-modifier.solace.com/webhook-version", Version: "v20231001-abc"}
+	assertPatch(t, mutate(t, testPod("broker-0", "broker"), cfg, opts).Patch, `[
+		{"op":"add","path":"/metadata/annotations","value":{"pod-modifier.solace.com/webhook-version":"v20231001-abc"}},
+		{"op":"replace","path":"/spec/containers/0/image","value":"broker:2"}
+	]`)
+}
+
+func TestMutateSetHostnameAsFQDN(t *testing.T) {
+	fqdn := true
+	cfg := testConfig("broker-0")
+	cfg.Pods[0].Spec.SetHostnameAsFQDN = &fqdn
+	assertPatch(t, mutate(t, testPod("broker-0", "broker"), cfg, Options{}).Patch,
+		`[{"op":"add","path":"/spec/setHostnameAsFQDN","value":true}]`)
+
+	assertPatch(t, mutate(t, testPod("broker-0", "broker"), testConfig("broker-0"), Options{}).Patch, "")
+}
+
+func TestMutateNodeAllocatable(t *testing.T) {
+	cfg := testConfig("broker-0", corev1.Container{
+		Name: "broker",
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("16Gi")},
+		},
+	})
+	nodes := []corev1.ResourceList{
+		{corev1.ResourceMemory: resource.MustParse("8Gi")},
+		{corev1.ResourceMemory: resource.MustParse("12Gi")},
+	}
+
+	result := mutate(t, testPod("broker-0", "broker"), cfg, Options{NodeAllocatable: nodes})
+	if len(result.Patch) == 0 {
+		t.Fatal("expected the pod to be patched despite the warning")
+	}
+	if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], "more resources than any node can allocate") {
+		t.Fatalf("expected a node allocatable warning, got %v", result.Warnings)
+	}
+
+	nodes = append(nodes, corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("32Gi")})
+	if result := mutate(t, testPod("broker-0", "broker"), cfg, Options{NodeAllocatable: nodes}); len(result.Warnings) != 0 {
+		t.Fatalf("expected no warning when a node fits the pod, got %v", result.Warnings)
+	}
+
+	// no nodes listed, nothing to check against
+	if result := mutate(t, testPod("broker-0", "broker"), cfg, Options{NodeAllocatable: []corev1.ResourceList{}}); len(result.Warnings) != 0 {
+		t.Fatalf("expected no warning without nodes, got %v", result.Warnings)
+	}
+}
+
+func TestPodRequests(t *testing.T) {
+	pod := testPod("broker-0", "broker", "sidecar")
+	pod.Spec.Containers[0].Resources.Requests = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}
+	pod.Spec.Containers[1].Resources.Requests = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m")}
+	pod.Spec.InitContainers = []corev1.Container{{
+		Name:      "setup",
+		Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("2")}},
+	}}
+
+	if cpu := podRequests(pod)[corev1.ResourceCPU]; cpu.String() != "2" {
+		t.Fatalf("expected the init container's cpu request of 2, got %s", cpu.String())
+	}
+	pod.Spec.InitContainers[0].Resources.Requests[corev1.ResourceCPU] = resource.MustParse("1")
+	if cpu := podRequests(pod)[corev1.ResourceCPU]; cpu.String() != "1500m" {
+		t.Fatalf("expected the containers' total cpu request of 1500m, got %s", cpu.String())
+	}
+}
+
+func TestMutateContainersByIndex(t *testing.T) {
+	cfg := testConfig("broker-0")
+	cfg.Pods[0].ContainersByIndex = []IndexedContainer{
+		{Index: 1, Container: corev1.Container{Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+		}}},
+		{Index: 5, Container: corev1.Container{Image: "ignored"}},
+	}
+
+	pod := testPod("broker-0", "app", "app")
+	result := mutate(t, pod, cfg, Options{})
+	assertPatch(t, result.Patch, `[{"op":"add","path":"/spec/containers/1/resources/limits","value":{"memory":"1Gi"}}]`)
+	if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], "index 5") {
+		t.Fatalf("expected a warning about index 5, got %v", result.Warnings)
+	}
+}
+
+func TestMutateSecurityContextMerge(t *testing.T) {
+	nonRoot := true
+	readOnly := true
+	cfg := testConfig("broker-0", corev1.Container{
+		Name:            "broker",
+		SecurityContext: &corev1.SecurityContext{RunAsNonRoot: &nonRoot},
+	})
+
+	pod := testPod("broker-0", "broker")
+	pod.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{ReadOnlyRootFilesystem: &readOnly}
+
+	cfg.Pods[0].SecurityContextPolicy = SecurityContextPolicyMerge
+	assertPatch(t, mutate(t, pod, cfg, Options{}).Patch,
+		`[{"op":"add","path":"/spec/containers/0/securityContext/runAsNonRoot","value":true}]`)
+
+	cfg.Pods[0].SecurityContextPolicy = SecurityContextPolicyReplace
+	patched := applyPatch(t, pod, mutate(t, pod, cfg, Options{}).Patch)
+	if sc := patched.Spec.Containers[0].SecurityContext; sc.ReadOnlyRootFilesystem != nil || sc.RunAsNonRoot == nil {
+		t.Fatalf("expected the security context to be replaced, got %v", sc)
+	}
+}
+
+func TestMutateDNSConfig(t *testing.T) {
+	two := "2"
+	cfg := testConfig("broker-0")
+	cfg.Pods[0].Spec.DNSConfig = &corev1.PodDNSConfig{
+		Options: []corev1.PodDNSConfigOption{{Name: "ndots", Value: &two}},
+	}
+
+	five := "5"
+	pod := testPod("broker-0", "broker")
+	pod.Spec.DNSConfig = &corev1.PodDNSConfig{
+		Searches: []string{"brokers.svc.cluster.local"},
+		Options:  []corev1.PodDNSConfigOption{{Name: "ndots", Value: &five}, {Name: "edns0"}},
+	}
+	patched := applyPatch(t, pod, mutate(t, pod, cfg, Options{}).Patch)
+
+	dns := patched.Spec.DNSConfig
+	if !reflect.DeepEqual(dns.Searches, []string{"brokers.svc.cluster.local"}) {
+		t.Errorf("expected the search domain to be kept, got %v", dns.Searches)
+	}
+	if len(dns.Options) != 2 || dns.Options[0].Name != "ndots" || *dns.Options[0].Value != "2" || dns.Options[1].Name != "edns0" {
+		t.Errorf("expected options ndots:2 and edns0, got %v", dns.Options)
+	}
+}
+
+func TestMutateImagePullPolicy(t *testing.T) {
+	cfg := testConfig("broker-0", corev1.Container{Name: "monitor", ImagePullPolicy: corev1.PullIfNotPresent})
+	cfg.Pods[0].ImagePullPolicy = corev1.PullAlways
+
+	pod := testPod("broker-0", "broker", "sidecar", "monitor")
+	pod.Spec.InitContainers = []corev1.Container{{Name: "setup", Image: "setup:1"}}
+	patched := applyPatch(t, pod, mutate(t, pod, cfg, Options{}).Patch)
+	for i, policy := range []corev1.PullPolicy{corev1.PullAlways, corev1.PullAlways, corev1.PullIfNotPresent} {
+		if got := patched.Spec.Containers[i].ImagePullPolicy; got != policy {
+			t.Errorf("expected pull policy %s for %s, got %s", policy, patched.Spec.Containers[i].Name, got)
+		}
+	}
+	if got := patched.Spec.InitContainers[0].ImagePullPolicy; got != corev1.PullAlways {
+		t.Errorf("expected pull policy Always for the init container, got %s", got)
+	}
+}
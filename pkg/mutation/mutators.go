@@ -0,0 +1,455 @@
+package mutation
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// FieldMutator applies one kind of field from the matched config pod src to the pod dst.
+// Apply reports whether it set anything on dst.
+type FieldMutator interface {
+	Apply(src, dst *corev1.Pod) bool
+}
+
+// FieldMutatorFunc adapts a function to a FieldMutator
+type FieldMutatorFunc func(src, dst *corev1.Pod) bool
+
+func (f FieldMutatorFunc) Apply(src, dst *corev1.Pod) bool {
+	return f(src, dst)
+}
+
+// mutators applied, in registration order, after the built-in ones
+var fieldMutators []FieldMutator
+
+// RegisterFieldMutator adds a mutator applied to every pod matching a config entry. It is
+// meant to be called from an init function, before any pod is mutated.
+func RegisterFieldMutator(m FieldMutator) {
+	fieldMutators = append(fieldMutators, m)
+}
+
+// Return the mutators to apply for a config entry, built-in ones first
+func mutatorsFor(logger *mutationLog, cfg *Config, cpod ConfigPod, opts Options) []FieldMutator {
+	setters := containerSetters(cpod)
+	mutators := []FieldMutator{
+		imageOverrideMutator(cpod.ImageOverride),
+		imagePullPolicyMutator(cpod.ImagePullPolicy),
+		insertInitContainersMutator(cpod.InsertInitContainers),
+		containerOrderMutator(cpod.ContainerOrder),
+		ephemeralContainersMutator(logger, opts.AllowEphemeralContainers),
+	}
+	for _, set := range setters {
+		mutators = append(mutators, containerMutator{matcher: cfg.matcher, set: set})
+	}
+	mutators = append(mutators,
+		indexedContainersMutator{logger: logger, setters: setters,
+			containers: cpod.ContainersByIndex, initContainers: cpod.InitContainersByIndex},
+		derivedEnvMutator(cfg, cpod.DerivedEnv),
+		nodeNameMutator(logger),
+		FieldMutatorFunc(setTolerations),
+		FieldMutatorFunc(setSysctls),
+		FieldMutatorFunc(setDNSConfig),
+		FieldMutatorFunc(setHostname),
+		hostNamespacesMutator(logger, cpod),
+		FieldMutatorFunc(setAutomountServiceAccountToken),
+		FieldMutatorFunc(setEnableServiceLinks),
+		FieldMutatorFunc(setHostnameAsFQDN),
+		FieldMutatorFunc(setShareProcessNamespace),
+		FieldMutatorFunc(setLabels),
+		removeMetadataMutator(cpod.RemoveLabels, cpod.RemoveAnnotations),
+		ownerReferencesMutator(logger),
+	)
+	return append(mutators, fieldMutators...)
+}
+
+// Sets a field of the container dst from the config container src, reporting whether it did
+type containerSetter func(src corev1.Container, dst *corev1.Container) bool
+
+// Return the container fields applied for a config entry, in order
+func containerSetters(cpod ConfigPod) []containerSetter {
+	return []containerSetter{
+		setImage,
+		setEnv,
+		setVolumeDevices,
+		setResizePolicy,
+		setImagePullPolicy,
+		setTerminationMessagePolicy,
+		resourcesSetter(cpod.ResourcesPolicy),
+		securityContextSetter(cpod.SecurityContextPolicy),
+	}
+}
+
+// Applies a field of the config containers to the containers matching them by name
+type containerMutator struct {
+	matcher func(name string) (func(string) bool, error)
+	set     containerSetter
+}
+
+func (m containerMutator) Apply(src, dst *corev1.Pod) bool {
+	changed := m.apply(src.Spec.Containers, dst.Spec.Containers)
+	return m.apply(src.Spec.InitContainers, dst.Spec.InitContainers) || changed
+}
+
+func (m containerMutator) apply(configContainers []corev1.Container, containers []corev1.Container) bool {
+	changed := false
+	for _, configContainer := range configContainers {
+		matches, err := m.matcher(configContainer.Name)
+		if err != nil {
+			continue
+		}
+		for ii := range containers {
+			if matches(containers[ii].Name) && m.set(configContainer, &containers[ii]) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+func setImage(src corev1.Container, dst *corev1.Container) bool {
+	if src.Image == "" {
+		return false
+	}
+	dst.Image = src.Image
+	return true
+}
+
+func setEnv(src corev1.Container, dst *corev1.Container) bool {
+	if len(src.Env) == 0 {
+		return false
+	}
+	dst.Env = mergeEnv(dst.Env, src.Env)
+	return true
+}
+
+func setVolumeDevices(src corev1.Container, dst *corev1.Container) bool {
+	if len(src.VolumeDevices) == 0 {
+		return false
+	}
+	dst.VolumeDevices = mergeVolumeDevices(dst.VolumeDevices, src.VolumeDevices)
+	return true
+}
+
+func setResizePolicy(src corev1.Container, dst *corev1.Container) bool {
+	if len(src.ResizePolicy) == 0 {
+		return false
+	}
+	dst.ResizePolicy = append([]corev1.ContainerResizePolicy(nil), src.ResizePolicy...)
+	return true
+}
+
+func setImagePullPolicy(src corev1.Container, dst *corev1.Container) bool {
+	if src.ImagePullPolicy == "" {
+		return false
+	}
+	dst.ImagePullPolicy = src.ImagePullPolicy
+	return true
+}
+
+func setTerminationMessagePolicy(src corev1.Container, dst *corev1.Container) bool {
+	if src.TerminationMessagePolicy == "" {
+		return false
+	}
+	dst.TerminationMessagePolicy = src.TerminationMessagePolicy
+	return true
+}
+
+// Return the setter of container resources for the policy, one of the ResourcesPolicy
+// constants. A config container without resources leaves the container's alone.
+func resourcesSetter(policy string) containerSetter {
+	return func(src corev1.Container, dst *corev1.Container) bool {
+		if len(src.Resources.Limits)+len(src.Resources.Requests) == 0 {
+			return false
+		}
+		switch policy {
+		case ResourcesPolicyOnlyIfLessThan:
+			dst.Resources = raiseResources(dst.Resources, src.Resources)
+		case ResourcesPolicyOnlyIfUnset:
+			if len(dst.Resources.Limits) > 0 || len(dst.Resources.Requests) > 0 {
+				return false
+			}
+			dst.Resources = *src.Resources.DeepCopy()
+		default:
+			dst.Resources = *src.Resources.DeepCopy()
+		}
+		return true
+	}
+}
+
+// Return the setter of container security contexts for the policy, one of the
+// SecurityContextPolicy constants
+func securityContextSetter(policy string) containerSetter {
+	return func(src corev1.Container, dst *corev1.Container) bool {
+		if src.SecurityContext == nil {
+			return false
+		}
+		switch policy {
+		case SecurityContextPolicyMerge:
+			dst.SecurityContext = mergeSecurityContext(dst.SecurityContext, src.SecurityContext)
+		default:
+			dst.SecurityContext = src.SecurityContext.DeepCopy()
+		}
+		return true
+	}
+}
+
+// Applies the config containers targeting pod containers by position, as config containers
+// naming them would be. An index outside the containers is skipped with a warning.
+type indexedContainersMutator struct {
+	logger  *mutationLog
+	setters []containerSetter
+
+	containers     []IndexedContainer
+	initContainers []IndexedContainer
+}
+
+func (m indexedContainersMutator) Apply(src, dst *corev1.Pod) bool {
+	changed := m.apply(m.containers, dst.Spec.Containers)
+	return m.apply(m.initContainers, dst.Spec.InitContainers) || changed
+}
+
+func (m indexedContainersMutator) apply(targets []IndexedContainer, containers []corev1.Container) bool {
+	changed := false
+	for _, target := range targets {
+		if target.Index < 0 || target.Index >= len(containers) {
+			m.logger.Warningf("Ignoring config container for index %d, the pod has %d", target.Index, len(containers))
+			continue
+		}
+		for _, set := range m.setters {
+			set(target.Container, &containers[target.Index])
+		}
+		changed = true
+	}
+	return changed
+}
+
+// Sets the image on every container of the pod, before the config containers set their own
+func imageOverrideMutator(image string) FieldMutator {
+	return FieldMutatorFunc(func(src, dst *corev1.Pod) bool {
+		if image == "" {
+			return false
+		}
+		for ii := range dst.Spec.Containers {
+			dst.Spec.Containers[ii].Image = image
+		}
+		for ii := range dst.Spec.InitContainers {
+			dst.Spec.InitContainers[ii].Image = image
+		}
+		return len(dst.Spec.Containers)+len(dst.Spec.InitContainers) > 0
+	})
+}
+
+// Sets the pull policy on every container of the pod, before the config containers set their own
+func imagePullPolicyMutator(policy corev1.PullPolicy) FieldMutator {
+	return FieldMutatorFunc(func(src, dst *corev1.Pod) bool {
+		if policy == "" {
+			return false
+		}
+		for ii := range dst.Spec.Containers {
+			dst.Spec.Containers[ii].ImagePullPolicy = policy
+		}
+		for ii := range dst.Spec.InitContainers {
+			dst.Spec.InitContainers[ii].ImagePullPolicy = policy
+		}
+		return true
+	})
+}
+
+func insertInitContainersMutator(inserts []InitContainerInsert) FieldMutator {
+	return FieldMutatorFunc(func(src, dst *corev1.Pod) bool {
+		changed := false
+		for _, insert := range inserts {
+			var inserted bool
+			dst.Spec.InitContainers, inserted = insertContainer(dst.Spec.InitContainers, insert.Index, insert.Container)
+			changed = changed || inserted
+		}
+		return changed
+	})
+}
+
+func containerOrderMutator(order []string) FieldMutator {
+	return FieldMutatorFunc(func(src, dst *corev1.Pod) bool {
+		if len(order) == 0 {
+			return false
+		}
+		var reordered bool
+		dst.Spec.Containers, reordered = reorderContainers(dst.Spec.Containers, order)
+		return reordered
+	})
+}
+
+// Adds the config's ephemeral containers if allowed, warning either way
+func ephemeralContainersMutator(logger *mutationLog, allowed bool) FieldMutator {
+	return FieldMutatorFunc(func(src, dst *corev1.Pod) bool {
+		if len(src.Spec.EphemeralContainers) == 0 {
+			return false
+		}
+		if !allowed {
+			logger.Warningf("Ignoring ephemeral containers for pod %s/%s; enable them with -allowEphemeralContainers", dst.Namespace, dst.Name)
+			return false
+		}
+		var appended bool
+		dst.Spec.EphemeralContainers, appended = appendEphemeralContainers(dst.Spec.EphemeralContainers, src.Spec.EphemeralContainers)
+		if appended {
+			logger.Warningf("Adding ephemeral containers to pod %s/%s; the API server only accepts them on existing pods", dst.Namespace, dst.Name)
+		}
+		return appended
+	})
+}
+
+func derivedEnvMutator(cfg *Config, rules []DerivedEnv) FieldMutator {
+	return FieldMutatorFunc(func(src, dst *corev1.Pod) bool {
+		return applyDerivedEnv(cfg, dst.Spec.Containers, rules)
+	})
+}
+
+func nodeNameMutator(logger *mutationLog) FieldMutator {
+	return FieldMutatorFunc(func(src, dst *corev1.Pod) bool {
+		if src.Spec.NodeName == "" {
+			return false
+		}
+		logger.Warningf("Binding pod %s/%s to node %s; this bypasses the scheduler", dst.Namespace, dst.Name, src.Spec.NodeName)
+		dst.Spec.NodeName = src.Spec.NodeName
+		return true
+	})
+}
+
+func setTolerations(src, dst *corev1.Pod) bool {
+	if len(src.Spec.Tolerations) == 0 {
+		return false
+	}
+	var merged bool
+	dst.Spec.Tolerations, merged = mergeTolerations(dst.Spec.Tolerations, src.Spec.Tolerations)
+	return merged
+}
+
+func setSysctls(src, dst *corev1.Pod) bool {
+	if src.Spec.SecurityContext == nil || len(src.Spec.SecurityContext.Sysctls) == 0 {
+		return false
+	}
+	if dst.Spec.SecurityContext == nil {
+		dst.Spec.SecurityContext = &corev1.PodSecurityContext{}
+	}
+	dst.Spec.SecurityContext.Sysctls = mergeSysctls(dst.Spec.SecurityContext.Sysctls, src.Spec.SecurityContext.Sysctls)
+	return true
+}
+
+func setDNSConfig(src, dst *corev1.Pod) bool {
+	if src.Spec.DNSConfig == nil {
+		return false
+	}
+	dst.Spec.DNSConfig = mergeDNSConfig(dst.Spec.DNSConfig, src.Spec.DNSConfig)
+	return true
+}
+
+// Sets the hostname and subdomain, either of which may be set alone
+func setHostname(src, dst *corev1.Pod) bool {
+	changed := false
+	if src.Spec.Hostname != "" {
+		dst.Spec.Hostname = src.Spec.Hostname
+		changed = true
+	}
+	if src.Spec.Subdomain != "" {
+		dst.Spec.Subdomain = src.Spec.Subdomain
+		changed = true
+	}
+	return changed
+}
+
+// Sets the privileged host namespaces the config entry asks for, warning about each
+func hostNamespacesMutator(logger *mutationLog, cpod ConfigPod) FieldMutator {
+	return FieldMutatorFunc(func(src, dst *corev1.Pod) bool {
+		changed := false
+		if hostNetwork := hostNamespaceSetting(cpod.HostNetwork, src.Spec.HostNetwork); hostNetwork != nil {
+			logger.Warningf("Setting privileged hostNetwork=%v on pod %s/%s", *hostNetwork, dst.Namespace, dst.Name)
+			dst.Spec.HostNetwork = *hostNetwork
+			changed = true
+		}
+		if hostPID := hostNamespaceSetting(cpod.HostPID, src.Spec.HostPID); hostPID != nil {
+			logger.Warningf("Setting privileged hostPID=%v on pod %s/%s", *hostPID, dst.Namespace, dst.Name)
+			dst.Spec.HostPID = *hostPID
+			changed = true
+		}
+		if hostIPC := hostNamespaceSetting(cpod.HostIPC, src.Spec.HostIPC); hostIPC != nil {
+			logger.Warningf("Setting privileged hostIPC=%v on pod %s/%s", *hostIPC, dst.Namespace, dst.Name)
+			dst.Spec.HostIPC = *hostIPC
+			changed = true
+		}
+		return changed
+	})
+}
+
+func setAutomountServiceAccountToken(src, dst *corev1.Pod) bool {
+	if src.Spec.AutomountServiceAccountToken == nil {
+		return false
+	}
+	automount := *src.Spec.AutomountServiceAccountToken
+	dst.Spec.AutomountServiceAccountToken = &automount
+	return true
+}
+
+func setEnableServiceLinks(src, dst *corev1.Pod) bool {
+	if src.Spec.EnableServiceLinks == nil {
+		return false
+	}
+	enableServiceLinks := *src.Spec.EnableServiceLinks
+	dst.Spec.EnableServiceLinks = &enableServiceLinks
+	return true
+}
+
+func setHostnameAsFQDN(src, dst *corev1.Pod) bool {
+	if src.Spec.SetHostnameAsFQDN == nil {
+		return false
+	}
+	setHostnameAsFQDN := *src.Spec.SetHostnameAsFQDN
+	dst.Spec.SetHostnameAsFQDN = &setHostnameAsFQDN
+	return true
+}
+
+func setShareProcessNamespace(src, dst *corev1.Pod) bool {
+	if src.Spec.ShareProcessNamespace == nil {
+		return false
+	}
+	shareProcessNamespace := *src.Spec.ShareProcessNamespace
+	dst.Spec.ShareProcessNamespace = &shareProcessNamespace
+	return true
+}
+
+// Sets the config labels, which may be templated, e.g. member-id: "{{ordinal}}"
+func setLabels(src, dst *corev1.Pod) bool {
+	for key, value := range src.ObjectMeta.Labels {
+		if dst.ObjectMeta.Labels == nil {
+			dst.ObjectMeta.Labels = map[string]string{}
+		}
+		dst.ObjectMeta.Labels[key] = value
+	}
+	return len(src.ObjectMeta.Labels) > 0
+}
+
+func removeMetadataMutator(labels []string, annotations []string) FieldMutator {
+	return FieldMutatorFunc(func(src, dst *corev1.Pod) bool {
+		changed := false
+		for _, key := range labels {
+			if _, ok := dst.ObjectMeta.Labels[key]; ok {
+				delete(dst.ObjectMeta.Labels, key)
+				changed = true
+			}
+		}
+		for _, key := range annotations {
+			if _, ok := dst.ObjectMeta.Annotations[key]; ok {
+				delete(dst.ObjectMeta.Annotations, key)
+				changed = true
+			}
+		}
+		return changed
+	})
+}
+
+func ownerReferencesMutator(logger *mutationLog) FieldMutator {
+	return FieldMutatorFunc(func(src, dst *corev1.Pod) bool {
+		if len(src.ObjectMeta.OwnerReferences) == 0 {
+			return false
+		}
+		logger.Warningf("Replacing owner references of pod %s/%s; this changes how the pod is garbage collected", dst.Namespace, dst.Name)
+		dst.ObjectMeta.OwnerReferences = src.ObjectMeta.OwnerReferences
+		return true
+	})
+}
@@ -0,0 +1,77 @@
+package mutation
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Records its calls, along with the CPU limit the first container had at the time
+type recordingMutator struct {
+	name  string
+	calls *[]string
+}
+
+func (m recordingMutator) Apply(src, dst *corev1.Pod) bool {
+	limit := dst.Spec.Containers[0].Resources.Limits[corev1.ResourceCPU]
+	*m.calls = append(*m.calls, m.name+" "+limit.String())
+	return false
+}
+
+// Sets a label on the pod
+type labelMutator struct{}
+
+func (labelMutator) Apply(src, dst *corev1.Pod) bool {
+	if dst.Labels == nil {
+		dst.Labels = map[string]string{}
+	}
+	dst.Labels["mutated-by"] = "plugin"
+	return true
+}
+
+func TestRegisteredFieldMutatorsRunInOrder(t *testing.T) {
+	defer func(registered []FieldMutator) { fieldMutators = registered }(fieldMutators)
+	var calls []string
+	RegisterFieldMutator(recordingMutator{name: "first", calls: &calls})
+	RegisterFieldMutator(recordingMutator{name: "second", calls: &calls})
+
+	cfg := testConfig("broker-0", corev1.Container{
+		Name: "broker",
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("2")},
+		},
+	})
+	if _, err := Mutate(testPod("broker-0", "broker"), nil, cfg, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the built-in resources mutator runs first, so both see the configured limit
+	if len(calls) != 2 || calls[0] != "first 2" || calls[1] != "second 2" {
+		t.Fatalf("expected calls [first 2, second 2], got %v", calls)
+	}
+}
+
+func TestRegisteredFieldMutatorChangesPatch(t *testing.T) {
+	defer func(registered []FieldMutator) { fieldMutators = registered }(fieldMutators)
+	RegisterFieldMutator(labelMutator{})
+
+	cfg := testConfig("broker-0", corev1.Container{Name: "broker", Image: "broker:2"})
+	result, err := Mutate(testPod("broker-0", "broker"), nil, cfg, Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertPatch(t, result.Patch, `[
+		{"op":"add","path":"/metadata/labels","value":{"mutated-by":"plugin"}},
+		{"op":"replace","path":"/spec/containers/0/image","value":"broker:2"}
+	]`)
+}
+
+func TestRegisteredFieldMutatorMarksPodChanged(t *testing.T) {
+	defer func(registered []FieldMutator) { fieldMutators = registered }(fieldMutators)
+	RegisterFieldMutator(labelMutator{})
+
+	// the entry sets nothing itself, the mutator's change alone is patched
+	result := mutate(t, testPod("broker-0", "broker"), testConfig("broker-0"), Options{})
+	assertPatch(t, result.Patch, `[{"op":"add","path":"/metadata/labels","value":{"mutated-by":"plugin"}}]`)
+}
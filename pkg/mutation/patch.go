@@ -0,0 +1,181 @@
+package mutation
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mattbaird/jsonpatch"
+)
+
+// Drop the patch operations that would not change the raw object as sent by the API
+// server, e.g. a replace with the value the object already holds. The patch is computed
+// from re-marshaled pods, so this keeps it limited to changes against the exact request.
+// The patch is returned unchanged if raw is empty or can't be decoded.
+func pruneNoopOperations(patch []jsonpatch.JsonPatchOperation, raw []byte) []jsonpatch.JsonPatchOperation {
+	if len(raw) == 0 {
+		return patch
+	}
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return patch
+	}
+
+	pruned := make([]jsonpatch.JsonPatchOperation, 0, len(patch))
+	for _, op := range patch {
+		current, exists := lookupPointer(doc, op.Path)
+		switch op.Operation {
+		case "remove":
+			if !exists {
+				continue
+			}
+		case "add":
+			// adding to an array inserts, it never leaves the array unchanged
+			if exists && !isArrayElement(doc, op.Path) && jsonEqual(current, op.Value) {
+				continue
+			}
+		case "replace":
+			if exists && jsonEqual(current, op.Value) {
+				continue
+			}
+		}
+		pruned = append(pruned, op)
+	}
+	return pruned
+}
+
+// Resolve a JSON pointer (RFC 6901) in a decoded JSON document
+func lookupPointer(doc interface{}, pointer string) (interface{}, bool) {
+	if pointer == "" {
+		return doc, true
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, false
+	}
+
+	current := doc
+	for _, token := range strings.Split(pointer[1:], "/") {
+		token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			current = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// Check whether the JSON pointer refers to an element of an array
+func isArrayElement(doc interface{}, pointer string) bool {
+	i := strings.LastIndex(pointer, "/")
+	if i < 0 {
+		return false
+	}
+	parent, ok := lookupPointer(doc, pointer[:i])
+	if !ok {
+		return false
+	}
+	_, isArray := parent.([]interface{})
+	return isArray
+}
+
+// Compare two values by their JSON representation
+func jsonEqual(a, b interface{}) bool {
+	aData, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bData, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	var aValue, bValue interface{}
+	if json.Unmarshal(aData, &aValue) != nil || json.Unmarshal(bData, &bValue) != nil {
+		return false
+	}
+	return reflect.DeepEqual(aValue, bValue)
+}
+
+// Check whether the patch only writes the webhook's own annotations, either the keys
+// themselves or an annotations map holding nothing else
+func onlyWebhookAnnotations(patch []jsonpatch.JsonPatchOperation, keys []string) bool {
+	keyPaths := map[string]bool{}
+	for _, key := range keys {
+		keyPaths["/metadata/annotations/"+strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)] = true
+	}
+	isKey := func(key string) bool {
+		for _, k := range keys {
+			if k == key {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, op := range patch {
+		if keyPaths[op.Path] {
+			continue
+		}
+		if op.Path != "/metadata/annotations" {
+			return false
+		}
+		annotations, ok := op.Value.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for key := range annotations {
+			if !isKey(key) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Sort patch operations by path so equal patches always come out the same. Array indexes
+// compare equal, so operations within an array keep their relative order, as their
+// indexes depend on it.
+func sortOperations(patch []jsonpatch.JsonPatchOperation) {
+	sort.SliceStable(patch, func(i, j int) bool {
+		return comparePaths(patch[i].Path, patch[j].Path) < 0
+	})
+}
+
+func comparePaths(a, b string) int {
+	aTokens := strings.Split(a, "/")
+	bTokens := strings.Split(b, "/")
+	for k := 0; k < len(aTokens) && k < len(bTokens); k++ {
+		if c := compareTokens(aTokens[k], bTokens[k]); c != 0 {
+			return c
+		}
+	}
+	return len(aTokens) - len(bTokens)
+}
+
+// Compare path tokens; array indexes are equal to each other and come before names
+func compareTokens(a, b string) int {
+	_, aErr := strconv.Atoi(a)
+	_, bErr := strconv.Atoi(b)
+	switch {
+	case aErr == nil && bErr == nil:
+		return 0
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
@@ -0,0 +1,67 @@
+package mutation
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/mattbaird/jsonpatch"
+)
+
+func TestPruneNoopOperations(t *testing.T) {
+	raw := []byte(`{"metadata":{"labels":{"app":"broker"}},"spec":{"containers":[{"name":"broker","image":"broker:2"}]}}`)
+	patch := []jsonpatch.JsonPatchOperation{
+		{Operation: "replace", Path: "/spec/containers/0/image", Value: "broker:2"},
+		{Operation: "add", Path: "/metadata/labels/app", Value: "broker"},
+		{Operation: "remove", Path: "/metadata/labels/missing"},
+		{Operation: "add", Path: "/spec/containers/0", Value: map[string]interface{}{"name": "broker", "image": "broker:2"}},
+		{Operation: "replace", Path: "/metadata/labels/app", Value: "other"},
+	}
+
+	pruned := pruneNoopOperations(patch, raw)
+	if len(pruned) != 2 {
+		t.Fatalf("expected 2 operations to remain, got %v", pruned)
+	}
+	if pruned[0].Path != "/spec/containers/0" || pruned[1].Value != "other" {
+		t.Fatalf("expected the array insert and the changed label to remain, got %v", pruned)
+	}
+	if got := pruneNoopOperations(patch, nil); len(got) != len(patch) {
+		t.Fatalf("expected the patch to be unchanged without raw, got %v", got)
+	}
+}
+
+func TestLookupPointer(t *testing.T) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(`{"metadata":{"annotations":{"example.com/a~b":"1"}},"items":[{"x":1}]}`), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := lookupPointer(doc, "/metadata/annotations/example.com~1a~0b"); !ok || v != "1" {
+		t.Errorf("expected the escaped annotation key to resolve, got %v %v", v, ok)
+	}
+	if v, ok := lookupPointer(doc, "/items/0/x"); !ok || v != float64(1) {
+		t.Errorf("expected the array element to resolve, got %v %v", v, ok)
+	}
+	if _, ok := lookupPointer(doc, "/items/1"); ok {
+		t.Error("expected an index past the end not to resolve")
+	}
+}
+
+func TestSortOperations(t *testing.T) {
+	patch := []jsonpatch.JsonPatchOperation{
+		{Operation: "replace", Path: "/spec/containers/1/image"},
+		{Operation: "add", Path: "/spec/hostname"},
+		{Operation: "replace", Path: "/spec/containers/0/image"},
+		{Operation: "add", Path: "/metadata/labels"},
+	}
+	sortOperations(patch)
+
+	var paths []string
+	for _, op := range patch {
+		paths = append(paths, op.Path)
+	}
+	// operations within the containers array keep their order
+	want := []string{"/metadata/labels", "/spec/containers/1/image", "/spec/containers/0/image", "/spec/hostname"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Fatalf("expected %v, got %v", want, paths)
+	}
+}
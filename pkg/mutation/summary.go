@@ -0,0 +1,94 @@
+package mutation
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Summarize the changes to the fields the config usually sets, e.g.
+// "broker.resources.limits.memory 1Gi -> 2Gi; broker.env +NODE_ROLE"
+func diffSummary(oldPod, newPod *corev1.Pod) string {
+	var changes []string
+	changes = append(changes, containersDiff(oldPod.Spec.InitContainers, newPod.Spec.InitContainers)...)
+	changes = append(changes, containersDiff(oldPod.Spec.Containers, newPod.Spec.Containers)...)
+	changes = append(changes, mapDiff("labels", oldPod.ObjectMeta.Labels, newPod.ObjectMeta.Labels)...)
+	changes = append(changes, mapDiff("annotations", oldPod.ObjectMeta.Annotations, newPod.ObjectMeta.Annotations)...)
+	return strings.Join(changes, "; ")
+}
+
+func containersDiff(oldContainers, newContainers []corev1.Container) []string {
+	var changes []string
+	for _, c := range newContainers {
+		var old *corev1.Container
+		for i := range oldContainers {
+			if oldContainers[i].Name == c.Name {
+				old = &oldContainers[i]
+				break
+			}
+		}
+		if old == nil {
+			changes = append(changes, "+"+c.Name)
+			continue
+		}
+
+		if old.Image != c.Image {
+			changes = append(changes, fmt.Sprintf("%s.image %s -> %s", c.Name, old.Image, c.Image))
+		}
+		changes = append(changes, resourceListDiff(c.Name+".resources.limits", old.Resources.Limits, c.Resources.Limits)...)
+		changes = append(changes, resourceListDiff(c.Name+".resources.requests", old.Resources.Requests, c.Resources.Requests)...)
+
+		oldEnv := map[string]string{}
+		for _, v := range old.Env {
+			oldEnv[v.Name] = v.String()
+		}
+		for _, v := range c.Env {
+			if prev, ok := oldEnv[v.Name]; !ok {
+				changes = append(changes, fmt.Sprintf("%s.env +%s", c.Name, v.Name))
+			} else if prev != v.String() {
+				changes = append(changes, fmt.Sprintf("%s.env ~%s", c.Name, v.Name))
+			}
+		}
+	}
+	return changes
+}
+
+func resourceListDiff(field string, oldList, newList corev1.ResourceList) []string {
+	names := make([]string, 0, len(newList))
+	for name := range newList {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+
+	var changes []string
+	for _, name := range names {
+		quantity := newList[corev1.ResourceName(name)]
+		old, ok := oldList[corev1.ResourceName(name)]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("%s.%s unset -> %s", field, name, quantity.String()))
+		} else if old.Cmp(quantity) != 0 {
+			changes = append(changes, fmt.Sprintf("%s.%s %s -> %s", field, name, old.String(), quantity.String()))
+		}
+	}
+	return changes
+}
+
+func mapDiff(field string, oldMap, newMap map[string]string) []string {
+	keys := make([]string, 0, len(newMap))
+	for key := range newMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var changes []string
+	for _, key := range keys {
+		if old, ok := oldMap[key]; !ok {
+			changes = append(changes, fmt.Sprintf("%s +%s", field, key))
+		} else if old != newMap[key] {
+			changes = append(changes, fmt.Sprintf("%s ~%s", field, key))
+		}
+	}
+	return changes
+}
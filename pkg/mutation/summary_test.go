@@ -0,0 +1,29 @@
+package mutation
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestDiffSummary(t *testing.T) {
+	oldPod := testPod("broker-0", "broker")
+	oldPod.Spec.Containers[0].Resources.Limits = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")}
+	oldPod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "MODE", Value: "a"}}
+
+	newPod := oldPod.DeepCopy()
+	newPod.Spec.Containers[0].Image = "broker:2"
+	newPod.Spec.Containers[0].Resources.Limits[corev1.ResourceMemory] = resource.MustParse("2Gi")
+	newPod.Spec.Containers[0].Resources.Limits[corev1.ResourceCPU] = resource.MustParse("1")
+	newPod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "MODE", Value: "b"}, {Name: "NODE_ROLE", Value: "primary"}}
+	newPod.Spec.Containers = append(newPod.Spec.Containers, corev1.Container{Name: "monitor"})
+	newPod.Labels = map[string]string{"role": "primary"}
+
+	want := "broker.image broker:1 -> broker:2; " +
+		"broker.resources.limits.cpu unset -> 1; broker.resources.limits.memory 1Gi -> 2Gi; " +
+		"broker.env ~MODE; broker.env +NODE_ROLE; +monitor; labels +role"
+	if got := diffSummary(oldPod, newPod); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}